@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	accountingQueueSize = 10000
+	accountingTimeout   = 10 * time.Second // per request
+	accountingRetries   = 5
+	accountingBackoff   = 1 * time.Second // doubled after each failed attempt
+
+	// accountingShutdownTimeout limits how long queued records are sent after
+	// the server stopped
+	accountingShutdownTimeout = 10 * time.Second
+)
+
+// AccountingRecord describes a message that was accepted by an upstream
+// server.
+type AccountingRecord struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	From       string    `json:"from"`
+	Rcpts      int       `json:"rcpts"`
+	Bytes      int64     `json:"bytes"`
+	Upstream   string    `json:"upstream"`
+	RoutingKey string    `json:"routing_key"`           // the key the upstream was looked up by, see mapping_key
+	ClientCert string    `json:"client_cert,omitempty"` // the verified client certificate's common name
+}
+
+// Accounting reports accepted messages to an HTTP endpoint, e.g. for billing
+// or quotas. Records are queued and sent in the background, one POST with a
+// JSON body per message, so reporting never delays the reply to the client.
+// Failed requests are retried with backoff. If the queue is full, records are
+// dropped.
+type Accounting struct {
+	url    string
+	client *http.Client
+	queue  chan AccountingRecord
+
+	mu     sync.RWMutex // guards closed, so Report doesn't send on a closed queue
+	closed bool
+	done   chan struct{}
+}
+
+func NewAccounting(url string) *Accounting {
+	a := &Accounting{
+		url:    url,
+		client: &http.Client{Timeout: accountingTimeout},
+		queue:  make(chan AccountingRecord, accountingQueueSize),
+		done:   make(chan struct{}),
+	}
+
+	go a.run()
+
+	return a
+}
+
+// Report queues r to be sent. It never blocks.
+func (a *Accounting) Report(r AccountingRecord) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		return
+	}
+
+	select {
+	case a.queue <- r:
+	default:
+		log.Warn("Accounting queue is full, dropping record", "from", r.From, "upstream", r.Upstream,
+			"bytes", r.Bytes)
+	}
+}
+
+// Close stops accepting records and waits up to timeout for the queued ones
+// to be sent. It returns false if the timeout expired.
+func (a *Accounting) Close(timeout time.Duration) bool {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+
+	select {
+	case <-a.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (a *Accounting) run() {
+	defer close(a.done)
+
+	for r := range a.queue {
+		a.send(r)
+	}
+}
+
+func (a *Accounting) send(r AccountingRecord) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		log.Error("Failed to encode accounting record", "error", err)
+		return
+	}
+
+	backoff := accountingBackoff
+	for attempt := 1; ; attempt++ {
+		err = a.post(body)
+		if err == nil {
+			return
+		}
+		if attempt == accountingRetries {
+			break
+		}
+
+		log.Debug("Failed to send accounting record, retrying", "attempt", attempt, "retry_in", backoff,
+			"error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	log.Warn("Failed to send accounting record, dropping it", "from", r.From, "upstream", r.Upstream,
+		"bytes", r.Bytes, "error", err)
+}
+
+func (a *Accounting) post(body []byte) error {
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Read the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAccounting(t *testing.T) {
+	records := make(chan AccountingRecord, 10)
+	release := make(chan struct{})
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt is held until the client got its reply, and fails
+		if attempts.Add(1) == 1 {
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var record AccountingRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			t.Errorf("decoding accounting record: %v", err)
+		}
+		records <- record
+	}))
+	defer srv.Close()
+
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "willi.test"))
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeFile(t, caFile, ca.pem)
+	up := startUpstream(t, &fakeUpstream{})
+	up.setHook(func(c *fakeConn, line string) bool {
+		if strings.HasPrefix(line, "RCPT TO:<unknown") {
+			c.reply("550 5.1.1 No such user")
+			return true
+		}
+		return false
+	})
+	p := startProxy(t, up.static(), "accounting_url: "+srv.URL, "tls_cert: "+certFile, "tls_key: "+keyFile,
+		"require_client_cert: true", "client_ca_file: "+caFile)
+
+	c := p.dial(t)
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{ca.issue(t, "tenant.test")}}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org", "other@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	var record AccountingRecord
+	select {
+	case record = <-records:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no accounting record received")
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("got %d attempts, want the failed one retried once", n)
+	}
+	if record.Time.Before(start) || record.Client != "127.0.0.1" || record.From != "sender@example.com" ||
+		record.Rcpts != 2 || record.Bytes < int64(len(testMessage)) || record.Upstream != up.addr() ||
+		record.RoutingKey != "rcpt@example.org" || record.ClientCert != "tenant.test" {
+		t.Errorf("got record %+v", record)
+	}
+
+	// Only accepted messages are reported
+	expectSMTPCode(t, sendMail(c, "rejected@example.com", []string{"unknown@example.org"}, testMessage), 550)
+	c.Reset()
+	if err := sendMail(c, "accepted@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case record = <-records:
+		if record.From != "accepted@example.com" || record.Rcpts != 1 {
+			t.Errorf("got record %+v, want the accepted message", record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no accounting record received")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// AcmeConfig configures certificates from an ACME CA like Let's Encrypt, see
+// acme.
+type AcmeConfig struct {
+	Domains      []string `json:"domains"`
+	CacheDir     string   `json:"cache_dir"`
+	Email        string   `json:"email"`
+	HttpListen   string   `json:"http_listen"`   // for HTTP-01 challenges
+	DirectoryUrl string   `json:"directory_url"` // empty for Let's Encrypt
+}
+
+// validateAcme checks c and sets its defaults.
+func validateAcme(c *AcmeConfig) error {
+	if len(c.Domains) == 0 || c.CacheDir == "" {
+		return fmt.Errorf("acme: domains and cache_dir are required")
+	}
+	if c.HttpListen == "" {
+		c.HttpListen = ":80"
+	}
+	return nil
+}
+
+// newAcmeManager returns the manager that obtains and renews the certificates
+// of c. They are stored in cache_dir, so a restart doesn't request them again.
+func newAcmeManager(c *AcmeConfig) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Cache:      autocert.DirCache(c.CacheDir),
+		Email:      c.Email,
+	}
+	if c.DirectoryUrl != "" {
+		m.Client = &acme.Client{DirectoryURL: c.DirectoryUrl}
+	}
+	return m
+}
+
+// acmeCertificate returns a tls.Config.GetCertificate callback that gets the
+// certificate from m. Many MTAs don't send SNI with STARTTLS, they get the
+// certificate of the first domain.
+func acmeCertificate(m *autocert.Manager, domains []string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			h := *hello
+			h.ServerName = domains[0]
+			hello = &h
+		}
+		return m.GetCertificate(hello)
+	}
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	units "github.com/docker/go-units"
+	"github.com/emersion/go-msgauth/dkim"
 	"github.com/hjson/hjson-go/v4"
 	log "github.com/inconshreveable/log15"
 )
@@ -13,22 +22,137 @@ import (
 type Duration time.Duration
 type ByteSize int
 type LogLvl log.Lvl
+type Regexp struct{ *regexp.Regexp }
 
 type Config struct {
-	LogLevel LogLvl
-	Listen   string
-	Domain   string
-
-	TlsCert string `json:"tls_cert"`
-	TlsKey  string `json:"tls_key"`
+	LogLevel      LogLvl `json:"loglevel"`
+	Listen        string `json:"listen"`
+	ProxyProtocol bool   `json:"proxy_protocol"`
+	Domain        string `json:"domain"`
+
+	MaxConnections          int    `json:"max_connections"`
+	MaxConnectionsPerIp     int    `json:"max_connections_per_ip"`
+	ConnectionRatePerMinute int    `json:"connection_rate_per_minute"`
+	ConnLimitAction         string `json:"conn_limit_action"`
+
+	LogLevels         map[string]LogLvl `json:"log_levels"`
+	LogRedactPatterns []Regexp          `json:"log_redact_patterns"`
+	LogFormat         string            `json:"log_format"`
+	LogTimestamps     bool              `json:"log_timestamps"`
+
+	TlsCert        string          `json:"tls_cert"`
+	TlsKey         string          `json:"tls_key"`
+	TlsCerts       []TlsCertConfig `json:"tls_certs"`
+	TlsAlpn        []string        `json:"tls_alpn"`
+	TlsServerNames []string        `json:"tls_server_names"`
+
+	Acme *AcmeConfig `json:"acme"`
+
+	RequireStarttls   bool   `json:"require_starttls"`
+	RequireClientCert bool   `json:"require_client_cert"`
+	ClientCaFile      string `json:"client_ca_file"`
+
+	TlsMinVersion   string   `json:"tls_min_version"`
+	TlsMaxVersion   string   `json:"tls_max_version"`
+	TlsCipherSuites []string `json:"tls_cipher_suites"`
+
+	DnsServers []string `json:"dns_servers"`
+	DnsTimeout Duration `json:"dns_timeout"`
+
+	UpstreamConnectTimeout  Duration `json:"upstream_connect_timeout"`
+	UpstreamGreetingTimeout Duration `json:"upstream_greeting_timeout"`
+	UpstreamTimeout         Duration `json:"upstream_timeout"`
+	UpstreamKeepAlive       Duration `json:"upstream_keepalive"`
+	UpstreamSourceAddresses []string `json:"upstream_source_addresses"`
+	UpstreamDialRetries     int      `json:"upstream_dial_retries"`
+	UpstreamDialBackoff     Duration `json:"upstream_dial_backoff"`
+	UpstreamAffinity        string   `json:"upstream_affinity"`
+	UpstreamFullFailover    bool     `json:"upstream_full_failover"`
+	UpstreamTlsMode         string   `json:"upstream_tls_mode"`
+
+	MaxIdlePerUpstream int      `json:"max_idle_per_upstream"`
+	MinIdlePerUpstream int      `json:"min_idle_per_upstream"`
+	IdleTimeout        Duration `json:"idle_timeout"`
+	PoolReapInterval   Duration `json:"pool_reap_interval"`
 
 	ReadTimeout        Duration `json:"read_timeout"`
+	CommandTimeout     Duration `json:"command_timeout"`
+	DataTimeout        Duration `json:"data_timeout"`
 	WriteTimeout       Duration `json:"write_timeout"`
 	MaxMessageBytes    ByteSize `json:"max_message_bytes"`
 	MaxRecipients      int      `json:"max_recipients"`
+	MaxRcptErrors      int      `json:"max_rcpt_errors"`
+	MaxTransactions    int      `json:"max_transactions_per_connection"`
+	MaxConnectionRcpts int      `json:"max_recipients_per_connection"`
+	LostAfterData      string   `json:"upstream_lost_after_data"`
+	ChunkingTimeout    Duration `json:"chunking_timeout"`
+	MappingKey         string   `json:"mapping_key"`
 	RecipientDelimiter string   `json:"recipient_delimiter"`
+	ForwardRcptParams  []string `json:"forward_rcpt_params"`
+	StripDsnParams     bool     `json:"strip_dsn_params"`
+
+	MappingCacheTtl         Duration `json:"mapping_cache_ttl"`
+	MappingCacheNegativeTtl Duration `json:"mapping_cache_negative_ttl"`
+	MappingCacheSize        int      `json:"mapping_cache_size"`
+
+	MaxConcurrentData int      `json:"max_concurrent_data"`
+	RequireHeaders    []string `json:"require_headers"`
+	LogHeaders        []string `json:"log_headers"`
+	RedactHeaders     []string `json:"redact_headers"`
+	XForward          bool     `json:"xforward"`
+	AddReceivedHeader bool     `json:"add_received_header"`
+
+	AllowedSenderDomains    []string `json:"allowed_sender_domains"`
+	AllowedRecipientDomains []string `json:"allowed_recipient_domains"`
+	DeniedRecipientDomains  []string `json:"denied_recipient_domains"`
+
+	FromAlignment       string   `json:"from_alignment"`
+	FromAlignmentExempt []string `json:"from_alignment_exempt"`
+	MaxReceivedHops     int      `json:"max_received_hops"`
+	MaxHeaderBytes      ByteSize `json:"max_header_bytes"`
+	MaxHeaderCount      int      `json:"max_header_count"`
+
+	PerSessionRate ByteSize `json:"per_session_rate"`
+	GlobalRate     ByteSize `json:"global_rate"`
+
+	DedupWindow Duration `json:"dedup_window"`
+	DedupAction string   `json:"dedup_action"`
+
+	AccountingUrl string `json:"accounting_url"`
+
+	AbruptDisconnectLogLevel LogLvl   `json:"abrupt_disconnect_log_level"`
+	SlowLogThreshold         Duration `json:"slow_log_threshold"`
+	LogCommandQuirks         bool     `json:"log_command_quirks"`
+
+	HealthListen     string   `json:"health_listen"`
+	HealthDrainDelay Duration `json:"health_drain_delay"`
+
+	DebugListen          string `json:"debug_listen"`
+	UpstreamErrorHistory int    `json:"upstream_error_history"`
+	AuxiliaryBindFatal   bool   `json:"auxiliary_bind_fatal"`
+
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	ShutdownMessage string   `json:"shutdown_message"`
+
+	StrictConfig bool `json:"strict_config"`
+
+	CheckUpstreamOnStart string `json:"check_upstream_on_start"`
+
+	Dkim        *DkimConfig       `json:"dkim"`
+	DkimOptions *dkim.SignOptions `json:"-"` // loaded from Dkim
 
-	Mappings []Mapping `json:"-"`
+	Mappings    []Mapping `json:"-"`
+	UnknownKeys []string  `json:"-"` // top-level keys that don't match any option
+}
+
+type TlsCertConfig struct {
+	Host string `json:"host"` // server name (SNI) pattern, optional
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+func (l LogLvl) MarshalText() ([]byte, error) {
+	return []byte(log.Lvl(l).String()), nil
 }
 
 func (l *LogLvl) UnmarshalText(b []byte) error {
@@ -40,6 +164,10 @@ func (l *LogLvl) UnmarshalText(b []byte) error {
 	return nil
 }
 
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
 func (d *Duration) UnmarshalText(b []byte) error {
 	x, err := time.ParseDuration(string(b))
 	if err != nil {
@@ -58,15 +186,30 @@ func (s *ByteSize) UnmarshalText(b []byte) error {
 	return nil
 }
 
+func (r Regexp) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Regexp) UnmarshalText(b []byte) error {
+	x, err := regexp.Compile(string(b))
+	if err != nil {
+		return err
+	}
+	r.Regexp = x
+	return nil
+}
+
 func parseMappings(mappings []interface{}) ([]Mapping, error) {
 	list := make([]Mapping, 0)
 	for _, m := range mappings {
 		v, ok := m.(map[string]interface{})
 		if !ok {
+			closeMappings(list)
 			return nil, fmt.Errorf("mappings: must contain {...} elements but has %T", m)
 		}
 		mapping, err := parseMapping(v)
 		if err != nil {
+			closeMappings(list)
 			return nil, err
 		}
 		list = append(list, mapping)
@@ -89,58 +232,222 @@ func parseMapping(mapping map[string]interface{}) (Mapping, error) {
 	switch mappingType {
 	case "static":
 		return parseStaticMapping(mapping)
-	case "csv":
-		return parseCSVMapping(mapping)
+	case "csv", "file":
+		return parseFileMapping(mapping, mappingType)
 	case "sql":
 		return parseSQLMapping(mapping)
+	case "ldap":
+		return parseLDAPMapping(mapping)
+	case "redis":
+		return parseRedisMapping(mapping)
+	default:
+		return nil, fmt.Errorf("'type:' must be one of 'static', 'csv', 'file', 'sql', 'ldap', 'redis' but was '%s'", mappingType)
+	}
+}
+
+func parseByteSize(v interface{}) (ByteSize, error) {
+	switch x := v.(type) {
+	case float64:
+		return ByteSize(x), nil
+	case int: // from YAML
+		return ByteSize(x), nil
+	case string:
+		var s ByteSize
+		err := s.UnmarshalText([]byte(x))
+		return s, err
 	default:
-		return nil, fmt.Errorf("'type:' must be one of 'static', 'csv', 'sql' but was '%s'", mappingType)
+		return 0, fmt.Errorf("must be a number or a string but was %T", v)
 	}
 }
 
 func parseStaticMapping(mapping map[string]interface{}) (Mapping, error) {
-	s, ok := mapping["server"]
+	upstream, err := parseUpstream(mapping)
+	if err != nil {
+		return nil, fmt.Errorf("static mapping: %w", err)
+	}
+
+	m, err := NewStaticMapping(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("static mapping: %w", err)
+	}
+
+	return m, nil
+}
+
+// upstreamKeys are the fields of an upstream server in a static mapping or an
+// entry of a JSON or YAML mapping file.
+var upstreamKeys = []string{"server", "tls_verify", "tls_mode", "tls_pin", "max_message_bytes", "auth_user",
+	"auth_password"}
+
+// parseUpstream reads the fields of an upstream server from fields. Other
+// keys are ignored.
+func parseUpstream(fields map[string]interface{}) (Upstream, error) {
+	s, ok := fields["server"]
 	if !ok {
-		return nil, fmt.Errorf("static mapping: missing 'server:'")
+		return Upstream{}, fmt.Errorf("missing 'server:'")
 	}
 
 	server, ok := s.(string)
 	if !ok {
-		return nil, fmt.Errorf("static mapping: server must be a string but was %T", s)
+		return Upstream{}, fmt.Errorf("server must be a string but was %T", s)
 	}
 
-	v, ok := mapping["tls_verify"]
+	v, ok := fields["tls_verify"]
 	if !ok {
 		v = true
 	}
 
 	tlsVerify, ok := v.(bool)
 	if !ok {
-		return nil, fmt.Errorf("static mapping: tls_verify must be bool, but was %T", v)
+		return Upstream{}, fmt.Errorf("tls_verify must be bool, but was %T", v)
 	}
 
-	m, err := NewStaticMapping(server, tlsVerify)
-	if err != nil {
-		return nil, fmt.Errorf("static mapping: %w", err)
+	var tlsMode TlsMode
+	if v, ok := fields["tls_mode"]; ok {
+		m, ok := v.(string)
+		if !ok {
+			return Upstream{}, fmt.Errorf("tls_mode must be a string but was %T", v)
+		}
+		mode, err := ParseTlsMode(m)
+		if err != nil {
+			return Upstream{}, fmt.Errorf("tls_mode: %w", err)
+		}
+		tlsMode = mode
 	}
 
-	return m, nil
+	var tlsPin string
+	if v, ok := fields["tls_pin"]; ok {
+		p, ok := v.(string)
+		if !ok {
+			return Upstream{}, fmt.Errorf("tls_pin must be a string but was %T", v)
+		}
+		pin, err := ParseTlsPin(p)
+		if err != nil {
+			return Upstream{}, fmt.Errorf("tls_pin: %w", err)
+		}
+		tlsPin = pin
+	}
+
+	var maxMessageBytes ByteSize
+	if v, ok := fields["max_message_bytes"]; ok {
+		size, err := parseByteSize(v)
+		if err != nil {
+			return Upstream{}, fmt.Errorf("max_message_bytes: %w", err)
+		}
+		maxMessageBytes = size
+	}
+
+	var authUser string
+	if v, ok := fields["auth_user"]; ok {
+		if authUser, ok = v.(string); !ok {
+			return Upstream{}, fmt.Errorf("auth_user must be a string but was %T", v)
+		}
+	}
+
+	var authPassword string
+	if v, ok := fields["auth_password"]; ok {
+		if authPassword, ok = v.(string); !ok {
+			return Upstream{}, fmt.Errorf("auth_password must be a string but was %T", v)
+		}
+	}
+
+	if err := checkUpstreamAuth(authUser, authPassword); err != nil {
+		return Upstream{}, err
+	}
+
+	return Upstream{
+		Server:    server,
+		TlsVerify: tlsVerify,
+		TlsMode:   tlsMode,
+		TlsPin:    tlsPin,
+
+		MaxMessageBytes: int(maxMessageBytes),
+
+		AuthUser:     authUser,
+		AuthPassword: authPassword,
+	}, nil
 }
 
-func parseCSVMapping(mapping map[string]interface{}) (Mapping, error) {
+// parseUpstreamEntry is parseUpstream for an entry of a mapping file, where
+// unknown keys are most likely typos and rejected.
+func parseUpstreamEntry(entry map[string]interface{}) (Upstream, error) {
+	for key := range entry {
+		known := false
+		for _, k := range upstreamKeys {
+			known = known || key == k
+		}
+		if !known {
+			return Upstream{}, fmt.Errorf("unknown field '%s', must be one of '%s'", key,
+				strings.Join(upstreamKeys, "', '"))
+		}
+	}
+
+	return parseUpstream(entry)
+}
+
+// parseFileMapping parses a mapping of type csv, or of type file, whose format
+// is either set or derived from the extension of the file.
+func parseFileMapping(mapping map[string]interface{}, mappingType string) (Mapping, error) {
 	f, ok := mapping["file"]
 	if !ok {
-		return nil, fmt.Errorf("csv mapping: missing 'file:'")
+		return nil, fmt.Errorf("%s mapping: missing 'file:'", mappingType)
 	}
 
 	file, ok := f.(string)
 	if !ok {
-		return nil, fmt.Errorf("csv mapping: 'file:' must be a string but was %T", f)
+		return nil, fmt.Errorf("%s mapping: 'file:' must be a string but was %T", mappingType, f)
+	}
+
+	var interval Duration
+	if i, ok := mapping["reload_interval"]; ok {
+		x, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s mapping: 'reload_interval:' must be a string but was %T", mappingType, i)
+		}
+		if err := interval.UnmarshalText([]byte(x)); err != nil {
+			return nil, fmt.Errorf("%s mapping: reload_interval: %w", mappingType, err)
+		}
+		if interval != 0 && time.Duration(interval) < fileMappingMinInterval {
+			return nil, fmt.Errorf("%s mapping: 'reload_interval:' must be at least %s", mappingType,
+				fileMappingMinInterval)
+		}
 	}
 
-	m, err := NewCSVMapping(file)
+	format := "csv"
+	if mappingType == "file" {
+		if v, ok := mapping["format"]; ok {
+			format, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("file mapping: 'format:' must be a string but was %T", v)
+			}
+		} else {
+			switch strings.ToLower(filepath.Ext(file)) {
+			case ".csv":
+				format = "csv"
+			case ".json":
+				format = "json"
+			case ".yaml", ".yml":
+				format = "yaml"
+			default:
+				return nil, fmt.Errorf("file mapping: can't tell the format of '%s' by its extension, set 'format:'", file)
+			}
+		}
+	}
+
+	var m Mapping
+	var err error
+	switch format {
+	case "csv":
+		m, err = NewCSVMapping(file, time.Duration(interval))
+	case "json":
+		m, err = NewJSONMapping(file, time.Duration(interval))
+	case "yaml":
+		m, err = NewYAMLMapping(file, time.Duration(interval))
+	default:
+		return nil, fmt.Errorf("file mapping: 'format:' must be one of 'csv', 'json', 'yaml' but was '%s'", format)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("csv mapping: %w", err)
+		return nil, fmt.Errorf("%s mapping: %w", mappingType, err)
 	}
 
 	return m, nil
@@ -175,22 +482,138 @@ func parseSQLMapping(mapping map[string]interface{}) (Mapping, error) {
 	return m, nil
 }
 
-func loadConfigFile(configFile string) (*Config, error) {
-	d, err := os.ReadFile(configFile)
+func parseLDAPMapping(mapping map[string]interface{}) (Mapping, error) {
+	fields := map[string]string{}
+	for _, name := range []string{"ldap_url", "bind_dn", "bind_password", "base_dn", "filter", "server_attr",
+		"tls_verify_attr", "auth_user_attr", "auth_password_attr"} {
+
+		v, ok := mapping[name]
+		if !ok {
+			continue
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("ldap mapping: '%s:' must be a string but was %T", name, v)
+		}
+		fields[name] = s
+	}
+
+	for _, name := range []string{"ldap_url", "base_dn", "filter", "server_attr"} {
+		if fields[name] == "" {
+			return nil, fmt.Errorf("ldap mapping: missing '%s:'", name)
+		}
+	}
+
+	u, err := url.Parse(fields["ldap_url"])
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("ldap mapping: 'ldap_url:' must be an ldap:// or ldaps:// URL but was '%s'",
+			fields["ldap_url"])
+	}
+
+	if fields["bind_password"] != "" && fields["bind_dn"] == "" {
+		return nil, fmt.Errorf("ldap mapping: 'bind_password:' requires 'bind_dn:'")
+	}
+
+	if (fields["auth_user_attr"] == "") != (fields["auth_password_attr"] == "") {
+		return nil, fmt.Errorf("ldap mapping: 'auth_user_attr:' and 'auth_password_attr:' must be set together")
+	}
+
+	m, err := NewLDAPMapping(fields["ldap_url"], fields["bind_dn"], fields["bind_password"], fields["base_dn"],
+		fields["filter"], fields["server_attr"], fields["tls_verify_attr"], fields["auth_user_attr"],
+		fields["auth_password_attr"])
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("ldap mapping: %w", err)
+	}
+
+	return m, nil
+}
+
+func parseRedisMapping(mapping map[string]interface{}) (Mapping, error) {
+	u, ok := mapping["url"]
+	if !ok {
+		return nil, fmt.Errorf("redis mapping: missing 'url:'")
+	}
+
+	rawUrl, ok := u.(string)
+	if !ok {
+		return nil, fmt.Errorf("redis mapping: 'url:' must be a string but was %T", u)
+	}
+
+	var prefix string
+	if p, ok := mapping["key_prefix"]; ok {
+		prefix, ok = p.(string)
+		if !ok {
+			return nil, fmt.Errorf("redis mapping: 'key_prefix:' must be a string but was %T", p)
+		}
+	}
+
+	m, err := NewRedisMapping(rawUrl, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("redis mapping: %w", err)
+	}
+
+	return m, nil
+}
+
+// loadConfigFile reads configFile and applies the environment, see applyEnv.
+// Without configFile, only the defaults and the environment are used.
+func loadConfigFile(configFile string) (*Config, error) {
+	d := []byte("{}")
+	var err error
+	if configFile != "" {
+		if d, err = os.ReadFile(configFile); err != nil {
+			return nil, err
+		}
 	}
 
 	config := Config{
-		LogLevel: LogLvl(log.LvlInfo),
+		LogLevel:  LogLvl(log.LvlInfo),
+		LogFormat: "logfmt",
 
 		Listen: ":25",
 		Domain: getDefaultHostname(),
 
+		TlsMinVersion: "1.2",
+
+		DnsTimeout: Duration(5 * time.Second),
+
+		UpstreamDialBackoff: Duration(1 * time.Second),
+		UpstreamAffinity:    "none",
+		UpstreamTimeout:     Duration(5 * time.Minute),
+		UpstreamTlsMode:     string(TlsModeAuto),
+
+		IdleTimeout: Duration(30 * time.Second),
+
 		ReadTimeout:     Duration(10 * time.Second),
 		WriteTimeout:    Duration(10 * time.Second),
 		MaxMessageBytes: 20 * units.MiB,
 		MaxRecipients:   50,
+		LostAfterData:   "tempfail",
+		ConnLimitAction: "reject421",
+		ChunkingTimeout: Duration(10 * time.Minute),
+		MappingKey:      "rcpt",
+
+		MappingCacheNegativeTtl: Duration(30 * time.Second),
+		MappingCacheSize:        10000,
+
+		AbruptDisconnectLogLevel: LogLvl(log.LvlInfo),
+
+		FromAlignment:   "off",
+		MaxReceivedHops: 30,
+		MaxHeaderBytes:  1 * units.MiB,
+		MaxHeaderCount:  1000,
+
+		DedupAction: "accept",
+
+		UpstreamErrorHistory: 10,
+
+		HealthDrainDelay: Duration(5 * time.Second),
+
+		ShutdownTimeout: Duration(30 * time.Second),
+		ShutdownMessage: "Service shutting down. Please try again later.",
+
+		CheckUpstreamOnStart: "off",
 
 		Mappings: make([]Mapping, 0),
 	}
@@ -198,17 +621,230 @@ func loadConfigFile(configFile string) (*Config, error) {
 		return nil, err
 	}
 
+	// The environment takes precedence over the file, and is validated alike
+	if err := applyEnv(&config); err != nil {
+		return nil, err
+	}
+
+	switch config.FromAlignment {
+	case "off", "log", "enforce":
+	default:
+		return nil, fmt.Errorf("from_alignment must be one of 'off', 'log', 'enforce' but was '%s'", config.FromAlignment)
+	}
+
+	switch config.MappingKey {
+	case "rcpt", "rcpt_domain", "from_full", "from_domain":
+	case "client_cert_cn":
+		if !config.RequireClientCert {
+			return nil, fmt.Errorf("mapping_key 'client_cert_cn' requires require_client_cert")
+		}
+	case "username":
+		return nil, fmt.Errorf("mapping_key 'username' is not supported, willi does not support authentication")
+	default:
+		return nil, fmt.Errorf("mapping_key must be one of 'rcpt', 'rcpt_domain', 'from_full', 'from_domain', 'client_cert_cn' but was '%s'", config.MappingKey)
+	}
+
+	if config.MappingCacheTtl > 0 && (config.MappingCacheNegativeTtl < 0 || config.MappingCacheSize <= 0) {
+		return nil, fmt.Errorf("mapping_cache_negative_ttl must not be negative and mapping_cache_size must be positive if mapping_cache_ttl is set")
+	}
+
+	switch config.CheckUpstreamOnStart {
+	case "off", "log", "strict":
+	default:
+		return nil, fmt.Errorf("check_upstream_on_start must be one of 'off', 'log', 'strict' but was '%s'", config.CheckUpstreamOnStart)
+	}
+
+	switch config.LogFormat {
+	case "logfmt", "json":
+	default:
+		return nil, fmt.Errorf("log_format must be one of 'logfmt', 'json' but was '%s'", config.LogFormat)
+	}
+
+	switch config.ConnLimitAction {
+	case "reject421", "drop", "block":
+	default:
+		return nil, fmt.Errorf("conn_limit_action must be one of 'reject421', 'drop', 'block' but was '%s'", config.ConnLimitAction)
+	}
+
+	switch config.LostAfterData {
+	case "tempfail", "accept":
+	default:
+		return nil, fmt.Errorf("upstream_lost_after_data must be one of 'tempfail', 'accept' but was '%s'", config.LostAfterData)
+	}
+
+	// Without tls_cert/tls_key, STARTTLS isn't offered and the other TLS
+	// options would be ignored silently
+	if (config.TlsCert == "") != (config.TlsKey == "") {
+		return nil, fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if config.Acme != nil {
+		if config.TlsCert != "" || len(config.TlsCerts) > 0 {
+			return nil, fmt.Errorf("acme replaces tls_cert, tls_key and tls_certs, they can't be set together")
+		}
+		if err := validateAcme(config.Acme); err != nil {
+			return nil, err
+		}
+	} else if config.TlsCert == "" {
+		switch {
+		case len(config.TlsCerts) > 0:
+			return nil, fmt.Errorf("tls_certs requires tls_cert and tls_key")
+		case len(config.TlsServerNames) > 0:
+			return nil, fmt.Errorf("tls_server_names requires tls_cert and tls_key or acme")
+		case len(config.TlsAlpn) > 0:
+			return nil, fmt.Errorf("tls_alpn requires tls_cert and tls_key or acme")
+		case config.TlsMaxVersion != "":
+			return nil, fmt.Errorf("tls_max_version requires tls_cert and tls_key or acme")
+		case len(config.TlsCipherSuites) > 0:
+			return nil, fmt.Errorf("tls_cipher_suites requires tls_cert and tls_key or acme")
+		}
+	}
+	if err := applyTlsVersions(&tls.Config{}, &config); err != nil {
+		return nil, err
+	}
+	if config.RequireStarttls && config.TlsCert == "" && config.Acme == nil {
+		return nil, fmt.Errorf("require_starttls requires tls_cert and tls_key or acme")
+	}
+	if config.RequireClientCert && config.ClientCaFile == "" {
+		return nil, fmt.Errorf("require_client_cert requires client_ca_file")
+	}
+	if config.RequireClientCert && config.TlsCert == "" && config.Acme == nil {
+		return nil, fmt.Errorf("require_client_cert requires tls_cert and tls_key or acme")
+	}
+	for _, c := range config.TlsCerts {
+		if c.Cert == "" || c.Key == "" {
+			return nil, fmt.Errorf("tls_certs: each entry needs cert and key")
+		}
+	}
+
+	if config.PoolReapInterval < 0 {
+		return nil, fmt.Errorf("pool_reap_interval must not be negative")
+	}
+	if config.MinIdlePerUpstream < 0 || config.MinIdlePerUpstream > config.MaxIdlePerUpstream {
+		return nil, fmt.Errorf("min_idle_per_upstream must be between 0 and max_idle_per_upstream")
+	}
+	if config.MinIdlePerUpstream > 0 && config.IdleTimeout <= 0 && config.PoolReapInterval == 0 {
+		return nil, fmt.Errorf("min_idle_per_upstream requires pool_reap_interval if idle_timeout is 0")
+	}
+
+	if config.UpstreamDialRetries > 0 && config.UpstreamDialBackoff <= 0 {
+		return nil, fmt.Errorf("upstream_dial_backoff must be positive if upstream_dial_retries is set")
+	}
+
+	for _, addr := range config.UpstreamSourceAddresses {
+		if net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("upstream_source_addresses: '%s' is not an IP address", addr)
+		}
+	}
+
+	switch config.UpstreamAffinity {
+	case "none", "client_ip":
+	default:
+		return nil, fmt.Errorf("upstream_affinity must be one of 'none', 'client_ip' but was '%s'", config.UpstreamAffinity)
+	}
+
+	upstreamTlsMode, err := ParseTlsMode(config.UpstreamTlsMode)
+	if err != nil || upstreamTlsMode == TlsModeDefault {
+		return nil, fmt.Errorf("upstream_tls_mode must be one of 'auto', 'none', 'starttls', 'smtps' but was '%s'", config.UpstreamTlsMode)
+	}
+	config.UpstreamTlsMode = string(upstreamTlsMode)
+
+	switch config.DedupAction {
+	case "accept", "reject":
+	default:
+		return nil, fmt.Errorf("dedup_action must be one of 'accept', 'reject' but was '%s'", config.DedupAction)
+	}
+
+	if config.AccountingUrl != "" {
+		if u, err := url.Parse(config.AccountingUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("accounting_url must be an http or https URL but was '%s'", config.AccountingUrl)
+		}
+	}
+
+	if config.Dkim != nil {
+		if config.DkimOptions, err = dkimSignOptions(config.Dkim); err != nil {
+			return nil, err
+		}
+	}
+
+	// Both default to read_timeout, which used to apply to everything
+	if config.CommandTimeout == 0 {
+		config.CommandTimeout = config.ReadTimeout
+	}
+	if config.DataTimeout == 0 {
+		config.DataTimeout = config.ReadTimeout
+	}
+
 	var configMap map[string]interface{}
 	if err := hjson.Unmarshal(d, &configMap); err != nil {
 		return nil, err
 	}
-	if config.Mappings, err = parseMappings(configMap["mappings"].([]interface{})); err != nil {
+
+	config.UnknownKeys = unknownConfigKeys(configMap)
+	if config.StrictConfig && len(config.UnknownKeys) > 0 {
+		return nil, fmt.Errorf("unknown config keys: %s", strings.Join(config.UnknownKeys, ", "))
+	}
+
+	// Mappings come last: they may open connections and start goroutines, so
+	// nothing may fail after them, e.g. on a reload that is refused
+	if m, err := upstreamFromEnv(); err != nil {
 		return nil, err
+	} else if m != nil {
+		config.Mappings = []Mapping{m}
+	} else if mappings, ok := configMap["mappings"].([]interface{}); ok {
+		if config.Mappings, err = parseMappings(mappings); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("mappings: missing, and %s isn't set either", envUpstream)
+	}
+	if config.MappingCacheTtl > 0 {
+		cacheMappings(&config)
 	}
 
 	return &config, nil
 }
 
+// cacheMappings wraps the mappings that query external services in a
+// cachingMapping. Static and file mappings are in memory already.
+func cacheMappings(config *Config) {
+	for i, mapping := range config.Mappings {
+		switch mapping.(type) {
+		case *staticMapping, *fileMapping:
+			continue
+		}
+
+		config.Mappings[i] = NewCachingMapping(mapping, time.Duration(config.MappingCacheTtl),
+			time.Duration(config.MappingCacheNegativeTtl), config.MappingCacheSize)
+	}
+}
+
+// unknownConfigKeys returns the keys of configMap that don't match any field
+// of Config. Like hjson.Unmarshal, keys are matched case-insensitively.
+func unknownConfigKeys(configMap map[string]interface{}) []string {
+	known := map[string]bool{"mappings": true}
+
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		known[strings.ToLower(name)] = true
+	}
+
+	unknown := make([]string, 0)
+	for key := range configMap {
+		if !known[strings.ToLower(key)] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	return unknown
+}
+
 func getDefaultHostname() string {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnknownConfigKeys(t *testing.T) {
+	lines := []string{
+		`mappings: [{"type": "static", "server": "127.0.0.1:25"}]`,
+		"upstram_connect_timeout: 5s",
+		"Max_Recipients: 10",
+	}
+
+	config := loadTestConfig(t, lines...)
+	if len(config.UnknownKeys) != 1 || config.UnknownKeys[0] != "upstram_connect_timeout" {
+		t.Errorf("got unknown keys %q, want only the typo", config.UnknownKeys)
+	}
+	if config.MaxRecipients != 10 {
+		t.Errorf("got max_recipients %d, want 10 despite the case", config.MaxRecipients)
+	}
+
+	logs := captureLogs(t)
+	logConfig(config)
+	if len(logs.lines(`msg="Ignoring unknown config key"`, "key=upstram_connect_timeout")) != 1 {
+		t.Error("unknown key not logged")
+	}
+
+	_, err := loadConfigLines(t, append(lines, "strict_config: true")...)
+	if err == nil || !strings.Contains(err.Error(), "upstram_connect_timeout") {
+		t.Errorf("got %v with strict_config, want an error naming the typo", err)
+	}
+}
+
+func TestIncompleteTlsConfig(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "willi.test"))
+	otherCertFile, otherKeyFile := writeCertFiles(t, ca.issue(t, "other.test"))
+	mapping := `mappings: [{"type": "static", "server": "127.0.0.1:25"}]`
+
+	for _, tc := range []struct {
+		lines []string
+		want  string // part of the error
+	}{
+		{[]string{"tls_cert: " + certFile}, "tls_cert and tls_key must be set together"},
+		{[]string{"tls_key: " + keyFile}, "tls_cert and tls_key must be set together"},
+		{[]string{fmt.Sprintf(`tls_certs: [{"host": "mx.example.com", "cert": "%s", "key": "%s"}]`, certFile, keyFile)},
+			"tls_certs requires tls_cert and tls_key"},
+		{[]string{`tls_server_names: ["mx.example.com"]`}, "tls_server_names requires"},
+		{[]string{`tls_alpn: ["smtp"]`}, "tls_alpn requires"},
+		{[]string{"require_starttls: true"}, "require_starttls requires"},
+		{[]string{"tls_cert: " + certFile, "tls_key: " + keyFile,
+			fmt.Sprintf(`tls_certs: [{"host": "mx.example.com", "cert": "%s"}]`, otherCertFile)},
+			"each entry needs cert and key"},
+	} {
+		_, err := loadConfigLines(t, append([]string{mapping}, tc.lines...)...)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: got %v, want an error containing %q", tc.lines, err, tc.want)
+		}
+	}
+
+	// Certificates that don't load stop the startup as well
+	for _, lines := range [][]string{
+		{"tls_cert: " + certFile, "tls_key: " + otherKeyFile},
+		{"tls_cert: " + certFile, "tls_key: " + keyFile,
+			fmt.Sprintf(`tls_certs: [{"host": "mx.example.com", "cert": "%s", "key": "%s"}]`, otherCertFile, keyFile)},
+	} {
+		config := loadTestConfig(t, append([]string{mapping}, lines...)...)
+		if _, err := loadTlsCertificates(config); err == nil {
+			t.Errorf("%q: mismatching key accepted", lines)
+		}
+	}
+
+	config := loadTestConfig(t, mapping, "tls_cert: "+certFile, "tls_key: "+keyFile, "require_starttls: true")
+	if tlsConfig, err := loadTlsCertificates(config); err != nil || tlsConfig == nil {
+		t.Errorf("got %v, want a TLS config", err)
+	}
+}
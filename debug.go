@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// debugHandler serves internal state for operators. It must only be exposed
+// on trusted networks.
+func debugHandler(be *ProxyBackend, l *SessionListener) http.Handler {
+	mux := http.NewServeMux()
+
+	// /debug/config returns the running configuration, with secrets redacted.
+	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+		c, err := redactedConfig(be.Config())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, c)
+	})
+
+	// /debug/upstream_errors?server=<host:port> returns the recent errors of
+	// one upstream server, without the parameter those of all servers.
+	mux.HandleFunc("/debug/upstream_errors", func(w http.ResponseWriter, r *http.Request) {
+		if server := r.URL.Query().Get("server"); server != "" {
+			writeJSON(w, be.upstreamErrors.Get(server))
+			return
+		}
+		writeJSON(w, be.upstreamErrors.All())
+	})
+
+	// /debug/mapping_cache returns the hits and misses of the mapping caches,
+	// see mapping_cache_ttl.
+	mux.HandleFunc("/debug/mapping_cache", func(w http.ResponseWriter, r *http.Request) {
+		stats := make([]MappingCacheStats, 0)
+		for _, mapping := range be.Config().Mappings {
+			if c, ok := mapping.(*cachingMapping); ok {
+				stats = append(stats, c.Stats())
+			}
+		}
+		writeJSON(w, stats)
+	})
+
+	// /debug/connections returns the number of concurrent client connections
+	// and its peak since the start.
+	mux.HandleFunc("/debug/connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, l.Stats())
+	})
+
+	return mux
+}
+
+// redactedConfig returns config as generic JSON value. TLS and DKIM key paths
+// are replaced with <redacted>, mappings are shown by their String() method, which
+// never includes passwords.
+func redactedConfig(config *Config) (map[string]interface{}, error) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var c map[string]interface{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+
+	if config.TlsKey != "" {
+		c["tls_key"] = "<redacted>"
+	}
+	if certs, ok := c["tls_certs"].([]interface{}); ok {
+		for _, cert := range certs {
+			if cert, ok := cert.(map[string]interface{}); ok {
+				cert["key"] = "<redacted>"
+			}
+		}
+	}
+
+	if config.AccountingUrl != "" {
+		if u, err := url.Parse(config.AccountingUrl); err == nil {
+			c["accounting_url"] = u.Redacted()
+		}
+	}
+
+	if dkim, ok := c["dkim"].(map[string]interface{}); ok {
+		dkim["private_key"] = "<redacted>"
+	}
+
+	mappings := make([]string, len(config.Mappings))
+	for i, mapping := range config.Mappings {
+		mappings[i] = fmt.Sprint(mapping)
+	}
+	c["mappings"] = mappings
+
+	return c, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Warn("Failed to write debug response", "error", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fingerprintSkipHeaders are not part of a message fingerprint. They are added
+// on the way to willi and differ between two submissions of the same message.
+var fingerprintSkipHeaders = []string{"received", "return-path"}
+
+// DedupCache remembers the fingerprints of recently accepted messages.
+type DedupCache struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+}
+
+func NewDedupCache(window time.Duration) *DedupCache {
+	return &DedupCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Contains reports whether fingerprint was added within the window.
+func (c *DedupCache) Contains(fingerprint string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	added, ok := c.seen[fingerprint]
+	return ok && time.Since(added) < c.window
+}
+
+// Add records fingerprint and forgets all fingerprints older than the window.
+func (c *DedupCache) Add(fingerprint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for fp, added := range c.seen {
+		if now.Sub(added) >= c.window {
+			delete(c.seen, fp)
+		}
+	}
+	c.seen[fingerprint] = now
+}
+
+// fingerprintWriter hashes a message as it is written. The fingerprint covers
+// the envelope (sender and recipients), the header without
+// fingerprintSkipHeaders and the body. Line endings are normalized to LF.
+type fingerprintWriter struct {
+	h        hash.Hash
+	line     []byte // incomplete header line
+	inHeader bool
+	skipping bool // current header field is skipped, including continuation lines
+}
+
+func newFingerprintWriter(from string, rcpts []string) *fingerprintWriter {
+	w := &fingerprintWriter{h: sha256.New(), inHeader: true}
+
+	sorted := append([]string(nil), rcpts...)
+	sort.Strings(sorted)
+
+	w.h.Write([]byte(strings.ToLower(from) + "\n"))
+	for _, rcpt := range sorted {
+		w.h.Write([]byte(strings.ToLower(rcpt) + "\n"))
+	}
+	w.h.Write([]byte("\n"))
+
+	return w
+}
+
+func (w *fingerprintWriter) Write(b []byte) (int, error) {
+	n := len(b)
+
+	for w.inHeader && len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			w.line = append(w.line, b...)
+			return n, nil
+		}
+		w.line = append(w.line, b[:i+1]...)
+		b = b[i+1:]
+
+		w.writeHeaderLine(w.line)
+		w.line = w.line[:0]
+	}
+
+	w.h.Write(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")))
+	return n, nil
+}
+
+func (w *fingerprintWriter) writeHeaderLine(line []byte) {
+	line = append(bytes.TrimRight(line, "\r\n"), '\n')
+
+	if len(line) == 1 {
+		w.inHeader = false // end of header
+	} else if line[0] != ' ' && line[0] != '\t' {
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		w.skipping = false
+		for _, skip := range fingerprintSkipHeaders {
+			if strings.EqualFold(string(bytes.TrimSpace(name)), skip) {
+				w.skipping = true
+			}
+		}
+	}
+
+	if !w.skipping {
+		w.h.Write(line)
+	}
+}
+
+// Sum returns the fingerprint of everything written so far.
+func (w *fingerprintWriter) Sum() string {
+	if len(w.line) > 0 {
+		w.writeHeaderLine(w.line) // message without body
+		w.line = w.line[:0]
+	}
+	return hex.EncodeToString(w.h.Sum(nil))
+}
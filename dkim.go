@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// DkimConfig configures the DKIM signing of messages from senders in Domain,
+// see dkim.
+type DkimConfig struct {
+	Domain     string   `json:"domain"`
+	Selector   string   `json:"selector"`
+	PrivateKey string   `json:"private_key"` // path of a PEM file
+	Headers    []string `json:"headers"`
+}
+
+// dkimDefaultHeaders are the header fields that are signed unless headers is
+// set, those recommended by RFC 6376, section 5.4.1. Fields that are missing
+// from a message are signed as missing, so they can't be added later.
+var dkimDefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Resent-Date", "Resent-From", "Resent-To", "Resent-Cc",
+	"In-Reply-To", "References", "List-Id", "List-Help", "List-Unsubscribe", "List-Subscribe", "List-Post",
+	"List-Owner", "List-Archive", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// dkimSignOptions validates c and loads its private key.
+func dkimSignOptions(c *DkimConfig) (*dkim.SignOptions, error) {
+	if c.Domain == "" || c.Selector == "" || c.PrivateKey == "" {
+		return nil, fmt.Errorf("dkim: domain, selector and private_key are required")
+	}
+
+	headers := c.Headers
+	if len(headers) == 0 {
+		headers = dkimDefaultHeaders
+	}
+	hasFrom := false
+	for _, h := range headers {
+		hasFrom = hasFrom || strings.EqualFold(h, "From")
+	}
+	if !hasFrom {
+		return nil, fmt.Errorf("dkim: headers must include From")
+	}
+
+	key, err := loadDkimKey(c.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+
+	return &dkim.SignOptions{
+		Domain:                 c.Domain,
+		Selector:               c.Selector,
+		Signer:                 key,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             headers,
+	}, nil
+}
+
+// loadDkimKey reads an RSA (PKCS #1 or #8) or Ed25519 (PKCS #8) private key
+// from the PEM file at path.
+func loadDkimKey(path string) (crypto.Signer, error) {
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(d)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+	return signer, nil
+}
+
+// dkimSign returns the DKIM-Signature header for the complete message msg.
+func dkimSign(msg []byte, options *dkim.SignOptions) (string, error) {
+	signer, err := dkim.NewSigner(options)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := signer.Write(msg); err != nil {
+		signer.Close()
+		return "", err
+	}
+	if err := signer.Close(); err != nil {
+		return "", err
+	}
+
+	return signer.Signature(), nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// errNoAddressLeft is returned by Resolver.Dial if all addresses of the host
+// are excluded.
+var errNoAddressLeft = errors.New("no address left")
+
+// Resolver is used for all DNS lookups and for dialing upstream servers. If
+// no DNS servers are configured, the system resolver is used.
+type Resolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+	dial     DialOptions
+	next     atomic.Uint32 // index of the next source address
+}
+
+// DialOptions tune the connections to upstream servers.
+type DialOptions struct {
+	Timeout   time.Duration // 0 means no timeout other than the OS one
+	KeepAlive time.Duration // 0 means Go's default, negative disables keep-alive
+
+	// SourceAddrs are used in turn as local address. Each address has its own
+	// range of ephemeral ports, so several addresses help against port
+	// exhaustion. Empty means the OS picks the address.
+	SourceAddrs []net.IP
+}
+
+func NewResolver(servers []string, timeout time.Duration, dial DialOptions) *Resolver {
+	r := &net.Resolver{}
+
+	if len(servers) > 0 {
+		addrs := make([]string, len(servers))
+		for i, server := range servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			addrs[i] = server
+		}
+
+		r.PreferGo = true
+		r.Dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addrs[rand.Intn(len(addrs))])
+		}
+	}
+
+	return &Resolver{resolver: r, timeout: timeout, dial: dial}
+}
+
+func (r *Resolver) context() (context.Context, context.CancelFunc) {
+	if r.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), r.timeout)
+}
+
+func (r *Resolver) LookupAddr(addr string) ([]string, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	return r.resolver.LookupAddr(ctx, addr)
+}
+
+func (r *Resolver) LookupHost(host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+
+	ctx, cancel := r.context()
+	defer cancel()
+
+	return r.resolver.LookupHost(ctx, host)
+}
+
+// Dial resolves the host of address (<host>:<port>) and connects to the
+// resolved IPs in order until a connection succeeds. If affinity is not
+// empty, the IPs are ordered by affinity instead, see orderByAffinity. IPs in
+// exclude are skipped. The resolved and dialed IPs are logged (debug) to
+// logger.
+func (r *Resolver) Dial(address string, affinity string, exclude []string, logger log.Logger) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	logger = logger.New(componentKey, "dns", "host", host)
+
+	start := time.Now()
+	ips, err := r.LookupHost(host)
+	if err != nil {
+		logger.Debug("DNS lookup of upstream host failed", "duration", time.Since(start).Round(time.Microsecond),
+			"error", err)
+		return nil, err
+	}
+	if affinity != "" {
+		orderByAffinity(ips, affinity)
+	}
+	if net.ParseIP(host) == nil {
+		logger.Debug("Resolved upstream host", "ips", strings.Join(ips, ","),
+			"duration", time.Since(start).Round(time.Microsecond))
+	}
+
+	err = errNoAddressLeft
+	for _, ip := range ips {
+		if isExcluded(ip, exclude) {
+			continue
+		}
+
+		d := net.Dialer{
+			Timeout:   r.dial.Timeout,
+			KeepAlive: r.dial.KeepAlive,
+			LocalAddr: r.sourceAddr(net.ParseIP(ip)),
+		}
+
+		var c net.Conn
+		c, err = d.Dial("tcp", net.JoinHostPort(ip, port))
+		if err == nil {
+			logger.Debug("Connected to upstream address", "ip", ip)
+			return c, nil
+		}
+		logger.Debug("Connecting to upstream address failed", "ip", ip, "error", err)
+	}
+
+	return nil, fmt.Errorf("dial %s: %w", address, err)
+}
+
+func isExcluded(ip string, exclude []string) bool {
+	for _, x := range exclude {
+		if net.ParseIP(x).Equal(net.ParseIP(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// orderByAffinity sorts ips by a hash of each IP and affinity (rendezvous
+// hashing). The same affinity, e.g. a client IP, always gets the same order,
+// while different ones spread evenly over the IPs. If an IP is added or
+// removed, only the affinities that prefer it change their first choice.
+func orderByAffinity(ips []string, affinity string) {
+	weight := func(ip string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(affinity))
+		h.Write([]byte{0})
+		h.Write([]byte(ip))
+
+		// FNV alone spreads similar inputs unevenly, mix the bits (MurmurHash3's
+		// finalizer)
+		x := h.Sum64()
+		x ^= x >> 33
+		x *= 0xff51afd7ed558ccd
+		x ^= x >> 33
+		x *= 0xc4ceb9fe1a85ec53
+		x ^= x >> 33
+		return x
+	}
+
+	sort.SliceStable(ips, func(i, j int) bool {
+		return weight(ips[i]) > weight(ips[j])
+	})
+}
+
+// sourceAddr returns the next configured source address of the same family
+// as ip, or nil if there is none.
+func (r *Resolver) sourceAddr(ip net.IP) net.Addr {
+	if len(r.dial.SourceAddrs) == 0 || ip == nil {
+		return nil
+	}
+
+	// Addresses of the other family are skipped by advancing the counter, so
+	// the ones of each family are used evenly when both are configured
+	n := len(r.dial.SourceAddrs)
+	for i := 0; i < n; i++ {
+		addr := r.dial.SourceAddrs[int(r.next.Add(1)%uint32(n))]
+		if (addr.To4() == nil) == (ip.To4() == nil) {
+			return &net.TCPAddr{IP: addr}
+		}
+	}
+
+	return nil
+}
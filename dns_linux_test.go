@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+)
+
+func TestDialKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, tc := range []struct {
+		option string
+		idle   int // seconds, 0 if keep-alive is disabled
+	}{
+		{"upstream_keepalive: 42s", 42},
+		{"upstream_keepalive: -1s", 0},
+	} {
+		config := loadTestConfig(t, `mappings: [{"type": "static", "server": "127.0.0.1:25"}]`, tc.option)
+		be := newBackend(config, NewSessionLoggers())
+
+		conn, err := be.opts.resolver.Dial(l.Addr().String(), "", nil, log.Root())
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := conn.(*net.TCPConn).SyscallConn()
+		var enabled, idle int
+		raw.Control(func(fd uintptr) {
+			enabled, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+			idle, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		})
+		conn.Close()
+
+		if tc.idle == 0 && enabled != 0 {
+			t.Errorf("%s: keep-alive enabled", tc.option)
+		}
+		if tc.idle != 0 && (enabled == 0 || idle != tc.idle) {
+			t.Errorf("%s: got keep-alive %d after %ds, want it after %ds", tc.option, enabled, idle, tc.idle)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDialOptions(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "upstream_connect_timeout: 2s", "upstream_keepalive: 15s",
+		`upstream_source_addresses: ["127.0.0.2", "::1", "127.0.0.3"]`)
+
+	dial := p.be.opts.resolver.dial
+	if dial.Timeout != 2*time.Second || dial.KeepAlive != 15*time.Second || len(dial.SourceAddrs) != 3 {
+		t.Fatalf("got dial options %+v", dial)
+	}
+
+	c := p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatalf("message through a source address: %v", err)
+	}
+
+	// The IPv4 source addresses are used in turn, the IPv6 one doesn't fit
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	sources := map[string]int{}
+	for i := 0; i < 4; i++ {
+		conn, err := p.be.opts.resolver.Dial(l.Addr().String(), "", nil, log.Root())
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[accepted.RemoteAddr().(*net.TCPAddr).IP.String()]++
+		accepted.Close()
+		conn.Close()
+	}
+	if sources["127.0.0.2"] != 2 || sources["127.0.0.3"] != 2 {
+		t.Errorf("got connections from %v, want two from each IPv4 source address", sources)
+	}
+}
+
+// startDNS serves records on a loopback address and returns the address.
+// Records map lowercase names with a trailing dot to IPv4 addresses for A
+// queries, or to names for PTR queries. Other names don't exist.
+func startDNS(t *testing.T, records map[string][]string) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply, err := dnsReply(buf[:n], records); err == nil {
+				pc.WriteTo(reply, addr)
+			}
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func dnsReply(query []byte, records map[string][]string) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	answers, ok := records[strings.ToLower(q.Name.String())]
+	header := dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RecursionDesired: h.RecursionDesired}
+	if !ok {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, header)
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	for _, answer := range answers {
+		switch q.Type {
+		case dnsmessage.TypeA:
+			var a dnsmessage.AResource
+			copy(a.A[:], net.ParseIP(answer).To4())
+			err = b.AResource(rh, a)
+		case dnsmessage.TypePTR:
+			err = b.PTRResource(rh, dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(answer)})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+func TestUpstreamAffinity(t *testing.T) {
+	upstreams := []*fakeUpstream{startUpstream(t, &fakeUpstream{listen: "127.0.0.2:0"})}
+	_, port, _ := net.SplitHostPort(upstreams[0].addr())
+	upstreams = append(upstreams, startUpstream(t, &fakeUpstream{listen: "127.0.0.3:" + port}))
+	dns := startDNS(t, map[string][]string{"upstream.test.": {"127.0.0.2", "127.0.0.3"}})
+	p := startProxy(t, `mappings: [{"type": "static", "server": "upstream.test:`+port+`", "tls_verify": false}]`,
+		`dns_servers: ["`+dns+`"]`, "upstream_affinity: client_ip")
+
+	// Each client sticks to one upstream address, different ones are spread
+	// over both
+	used := map[int]bool{}
+	for i := 10; i < 18; i++ {
+		client := fmt.Sprintf("127.0.0.%d", i)
+		for j := 0; j < 3; j++ {
+			d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(client)}}
+			conn, err := d.Dial("tcp", p.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := smtp.NewClient(conn, "localhost")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Hello("client.test"); err != nil {
+				t.Fatal(err)
+			}
+			msg := "Subject: " + client + "\r\n\r\nHello\r\n"
+			if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, msg); err != nil {
+				t.Fatal(err)
+			}
+			c.Quit()
+		}
+
+		var hits []int
+		for k, up := range upstreams {
+			for _, msg := range up.delivered() {
+				if strings.Contains(msg, "Subject: "+client+"\r\n") {
+					hits = append(hits, k)
+				}
+			}
+		}
+		if len(hits) != 3 || hits[0] != hits[2] {
+			t.Errorf("client %s: got messages at upstreams %v, want all at the same", client, hits)
+		}
+		if len(hits) > 0 {
+			used[hits[0]] = true
+		}
+	}
+	if len(used) != 2 {
+		t.Errorf("got clients at upstreams %v, want both used", used)
+	}
+}
+
+func TestUpstreamFullFailover(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		failover bool
+		full     int32 // the number of addresses that get MAIL first and are full
+		want     int   // SMTP code for the RCPT
+	}{
+		{"failover", true, 1, 250},
+		{"all full", true, 2, 452},
+		{"no failover", false, 1, 452},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			var mails atomic.Int32
+			hook := func(c *fakeConn, line string) bool {
+				if strings.HasPrefix(line, "MAIL") && mails.Add(1) <= tc.full {
+					c.reply("452 4.3.1 Insufficient system storage")
+					return true
+				}
+				return false
+			}
+			upstreams := []*fakeUpstream{startUpstream(t, &fakeUpstream{listen: "127.0.0.2:0"})}
+			_, port, _ := net.SplitHostPort(upstreams[0].addr())
+			upstreams = append(upstreams, startUpstream(t, &fakeUpstream{listen: "127.0.0.3:" + port}))
+			for _, up := range upstreams {
+				up.setHook(hook)
+			}
+			dns := startDNS(t, map[string][]string{"upstream.test.": {"127.0.0.2", "127.0.0.3"}})
+			p := startProxy(t, `mappings: [{"type": "static", "server": "upstream.test:`+port+`", "tls_verify": false}]`,
+				`dns_servers: ["`+dns+`"]`, fmt.Sprintf("upstream_full_failover: %v", tc.failover))
+
+			c := p.dial(t)
+			if err := c.Mail("sender@example.com", nil); err != nil {
+				t.Fatal(err)
+			}
+			err := c.Rcpt("rcpt@example.org")
+			if tc.want != 250 {
+				expectSMTPCode(t, err, tc.want)
+				if code := err.(*smtp.SMTPError).EnhancedCode; code != (smtp.EnhancedCode{4, 3, 1}) {
+					t.Errorf("got enhanced code %v, want the upstream's 4.3.1", code)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			wantMails := tc.full
+			if tc.failover {
+				wantMails = 2
+			}
+			if n := mails.Load(); n != wantMails {
+				t.Errorf("got %d addresses tried, want %d", n, wantMails)
+			}
+			wantLogged := 0
+			if tc.failover {
+				wantLogged = int(tc.full)
+			}
+			if n := len(logs.lines(`msg="Upstream server is out of resources, trying next address"`)); n != wantLogged {
+				t.Errorf("got %d full addresses logged, want %d", n, wantLogged)
+			}
+			if tc.want != 250 {
+				return
+			}
+
+			w, err := c.Data()
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, testMessage)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(upstreams[0].delivered()) + len(upstreams[1].delivered()); n != 1 {
+				t.Errorf("got %d messages upstream, want 1", n)
+			}
+		})
+	}
+}
+
+func TestDnsLogging(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{listen: "127.0.0.2:0"})
+	_, port, _ := net.SplitHostPort(up.addr())
+	dns := startDNS(t, map[string][]string{"upstream.test.": {"127.0.0.2"}, "down.test.": {"127.0.0.4"}})
+	p := startProxy(t, `mappings: [{"type": "static", "server": "upstream.test:`+port+`", "tls_verify": false}]`,
+		`dns_servers: ["`+dns+`"]`, "loglevel: info", `log_levels: {"dns": "debug"}`)
+
+	// Logged like main does, only DNS details are debug
+	logs := &logBuffer{}
+	log.Root().SetHandler(logHandler(p.config, logs))
+	t.Cleanup(func() { log.Root().SetHandler(log.DiscardHandler()) })
+
+	c := p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs.lines(`msg="Resolved upstream host"`, "component=dns", "sid=", "host=upstream.test",
+		"ips=127.0.0.2", "duration=")) != 1 {
+		t.Error("resolved IPs not logged")
+	}
+	if len(logs.lines(`msg="Connected to upstream address"`, "component=dns", "ip=127.0.0.2")) != 1 {
+		t.Error("dialed IP not logged")
+	}
+
+	// Failures are logged as well
+	for _, host := range []string{"down.test", "unknown.test"} {
+		if conn, err := p.be.opts.resolver.Dial(host+":"+port, "", nil, log.Root()); err == nil {
+			conn.Close()
+			t.Fatalf("%s: connected", host)
+		}
+	}
+	if len(logs.lines(`msg="Connecting to upstream address failed"`, "host=down.test", "ip=127.0.0.4", "error=")) != 1 {
+		t.Error("failed connection not logged")
+	}
+	if len(logs.lines(`msg="DNS lookup of upstream host failed"`, "host=unknown.test", "error=")) != 1 {
+		t.Error("failed lookup not logged")
+	}
+	for _, line := range logs.lines("lvl=dbug") {
+		if !strings.Contains(line, "component=dns") {
+			t.Errorf("got %q, want only DNS details at debug level", line)
+		}
+	}
+}
+
+func TestAddReceivedHeader(t *testing.T) {
+	logs := captureLogs(t)
+	up := startUpstream(t, &fakeUpstream{})
+	dns := startDNS(t, map[string][]string{"10.0.0.127.in-addr.arpa.": {"mx.client.test."}})
+	p := startProxy(t, up.static(), `dns_servers: ["`+dns+`"]`, "domain: willi.test", "add_received_header: true")
+
+	dial := func(ip string) *smtp.Client {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		conn, err := d.Dial("tcp", p.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := smtp.NewClient(conn, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if err := c.Hello("client.test"); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// Two transactions, the client's hostname is looked up once
+	c := dial("127.0.0.10")
+	for _, rcpts := range [][]string{{"rcpt@example.org"}, {"a@example.org", "b@example.org"}} {
+		if err := sendMail(c, "sender@example.com", rcpts, testMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Quit()
+	if n := len(logs.lines(`msg="Resolved client hostname"`, "component=dns", "hostnames=mx.client.test.")); n != 1 {
+		t.Errorf("got %d lookups of the client hostname, want 1 per session", n)
+	}
+
+	// Without a PTR record, the hostname is unknown
+	c = dial("127.0.0.11")
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := up.delivered()
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages upstream, want 3", len(msgs))
+	}
+	for i, want := range []string{
+		"Received: from client.test (mx.client.test [127.0.0.10])\r\n\tby willi.test (willi) with ESMTP\r\n\tfor <rcpt@example.org>; ",
+		"Received: from client.test (mx.client.test [127.0.0.10])\r\n\tby willi.test (willi) with ESMTP; ",
+		"Received: from client.test (unknown [127.0.0.11])\r\n\tby willi.test (willi) with ESMTP\r\n\tfor <rcpt@example.org>; ",
+	} {
+		header := strings.TrimSuffix(msgs[i], testMessage)
+		if header == msgs[i] || !strings.HasPrefix(header, want) || !strings.HasSuffix(header, "\r\n") {
+			t.Errorf("got %q, want the message unchanged after %q", msgs[i], want)
+			continue
+		}
+		date := strings.TrimSuffix(strings.TrimPrefix(header, want), "\r\n")
+		if _, err := time.Parse(time.RFC1123Z, date); err != nil {
+			t.Errorf("got date %q: %v", date, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables that override the
+// config file, e.g. WILLI_LISTEN for listen.
+const envPrefix = "WILLI_"
+
+// Environment variables that replace the mappings of the config file by a
+// static mapping, see upstreamFromEnv.
+const (
+	envUpstream          = envPrefix + "UPSTREAM"
+	envUpstreamTls       = envPrefix + "UPSTREAM_TLS"
+	envUpstreamTlsVerify = envPrefix + "UPSTREAM_TLS_VERIFY"
+	envUpstreamTlsPin    = envPrefix + "UPSTREAM_TLS_PIN"
+
+	envUpstreamAuthUser     = envPrefix + "UPSTREAM_AUTH_USER"
+	envUpstreamAuthPassword = envPrefix + "UPSTREAM_AUTH_PASSWORD"
+)
+
+// applyEnv overrides the options of config that are set in the environment.
+// Each option is read from envPrefix followed by its name in upper case, and
+// parsed like in the config file: by the UnmarshalText method of its type if it
+// has one. Lists are separated by commas. Options of other types (mappings,
+// tls_certs, ...) can't be set in the environment.
+func applyEnv(config *Config) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		key := envPrefix + strings.ToUpper(name)
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		if err := setFromEnv(v.Field(i), value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func setFromEnv(field reflect.Value, value string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can't be set in the environment")
+		}
+		list := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = reflect.Append(list, reflect.ValueOf(s).Convert(field.Type().Elem()))
+			}
+		}
+		field.Set(list)
+	default:
+		return fmt.Errorf("can't be set in the environment")
+	}
+
+	return nil
+}
+
+// upstreamFromEnv returns the static mapping defined by WILLI_UPSTREAM (the
+// server) and optionally WILLI_UPSTREAM_TLS (tls_mode), WILLI_UPSTREAM_TLS_VERIFY,
+// WILLI_UPSTREAM_TLS_PIN, WILLI_UPSTREAM_AUTH_USER and
+// WILLI_UPSTREAM_AUTH_PASSWORD, or nil if WILLI_UPSTREAM isn't set.
+func upstreamFromEnv() (Mapping, error) {
+	server, ok := os.LookupEnv(envUpstream)
+	if !ok {
+		return nil, nil
+	}
+	if server == "" {
+		return nil, fmt.Errorf("%s must not be empty", envUpstream)
+	}
+
+	upstream := Upstream{Server: server, TlsVerify: true}
+
+	if v, ok := os.LookupEnv(envUpstreamTls); ok {
+		if err := upstream.TlsMode.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("%s: %w", envUpstreamTls, err)
+		}
+	}
+
+	if v, ok := os.LookupEnv(envUpstreamTlsVerify); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envUpstreamTlsVerify, err)
+		}
+		upstream.TlsVerify = b
+	}
+
+	if v, ok := os.LookupEnv(envUpstreamTlsPin); ok {
+		pin, err := ParseTlsPin(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envUpstreamTlsPin, err)
+		}
+		upstream.TlsPin = pin
+	}
+
+	upstream.AuthUser = os.Getenv(envUpstreamAuthUser)
+	upstream.AuthPassword = os.Getenv(envUpstreamAuthPassword)
+	if err := checkUpstreamAuth(upstream.AuthUser, upstream.AuthPassword); err != nil {
+		return nil, fmt.Errorf("%s and %s must be set together", envUpstreamAuthUser, envUpstreamAuthPassword)
+	}
+
+	return NewStaticMapping(upstream)
+}
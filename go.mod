@@ -2,21 +2,32 @@ module webflow/willi
 
 go 1.19
 
-require github.com/emersion/go-smtp v0.15.0
+require (
+	github.com/emersion/go-smtp v0.15.0
+	github.com/inconshreveable/log15 v0.0.0-20201112154412-8562bdadbbac
+)
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20200615164410-66371956d46c // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.1 // indirect
 	github.com/go-stack/stack v1.8.1 // indirect
-	github.com/inconshreveable/log15 v0.0.0-20201112154412-8562bdadbbac // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.16 // indirect
 	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab // indirect
+	golang.org/x/text v0.3.6 // indirect
 )
 
 require (
 	github.com/docker/go-units v0.5.0
-	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
+	github.com/emersion/go-msgauth v0.6.6
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
+	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/go-sql-driver/mysql v1.6.0
+	github.com/gomodule/redigo v1.8.9
 	github.com/hjson/hjson-go/v4 v4.2.0
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/pelletier/go-toml v1.9.5
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	gopkg.in/yaml.v3 v3.0.1
 )
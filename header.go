@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// readHeader reads the header section of a message from r. Only the header is
+// buffered, the body is left in r.
+//
+// It returns the parsed header and a reader that yields the complete and
+// unmodified message (header and body). If the header can't be parsed, the
+// fields parsed so far are returned together with the error.
+//
+// If the header is larger than maxBytes or has more than maxFields fields,
+// reading stops and ErrHeaderTooLarge is returned. 0 means no limit.
+func readHeader(r io.Reader, maxBytes int, maxFields int) (textproto.MIMEHeader, io.Reader, error) {
+	br := bufio.NewReader(r)
+	raw := &bytes.Buffer{}
+
+	lineLen := 0
+	fields := 0
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if lineLen == 0 && len(chunk) > 0 && chunk[0] != ' ' && chunk[0] != '\t' && !isBlankLine(chunk) {
+			fields++ // not a continuation line
+		}
+		raw.Write(chunk)
+		lineLen += len(chunk)
+
+		if (maxBytes > 0 && raw.Len() > maxBytes) || (maxFields > 0 && fields > maxFields) {
+			return nil, nil, ErrHeaderTooLarge
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue // line is longer than the buffer, read the rest of it
+		}
+		if err == io.EOF {
+			break // message without body
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if lineLen == len(chunk) && isBlankLine(chunk) {
+			break // end of header
+		}
+		lineLen = 0
+	}
+
+	msg := io.MultiReader(bytes.NewReader(raw.Bytes()), br)
+
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw.Bytes()))).ReadMIMEHeader()
+	if err == io.EOF {
+		err = nil // header without terminating blank line
+	}
+	if header == nil {
+		header = make(textproto.MIMEHeader)
+	}
+
+	return header, msg, err
+}
+
+func isBlankLine(line []byte) bool {
+	return bytes.Equal(line, []byte("\n")) || bytes.Equal(line, []byte("\r\n"))
+}
+
+// fromDomains returns the domains of all addresses in the From: header.
+func fromDomains(header textproto.MIMEHeader) ([]string, error) {
+	from := header.Get("From")
+	if from == "" {
+		return nil, fmt.Errorf("missing From header")
+	}
+
+	addrs, err := mail.ParseAddressList(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid From header: %w", err)
+	}
+
+	domains := make([]string, len(addrs))
+	for i, addr := range addrs {
+		domains[i] = addressDomain(addr.Address)
+	}
+
+	return domains, nil
+}
+
+// addressDomain returns the lowercase domain part of address.
+func addressDomain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return strings.ToLower(address[i+1:])
+	}
+	return ""
+}
+
+// domainMatches reports whether domain matches one of patterns, ignoring case.
+// A pattern "*.example.com" matches the subdomains of example.com (but not
+// example.com itself), "*" matches every domain.
+func domainMatches(domain string, patterns []string) bool {
+	for _, pattern := range patterns {
+		switch {
+		case pattern == "*":
+			return true
+		case strings.HasPrefix(pattern, "*."):
+			if len(domain) > len(pattern)-1 && strings.EqualFold(domain[len(domain)-len(pattern)+1:], pattern[1:]) {
+				return true
+			}
+		case strings.EqualFold(domain, pattern):
+			return true
+		}
+	}
+	return false
+}
+
+// domainsAligned reports whether a and b are the same domain or one is a
+// subdomain of the other (relaxed alignment).
+func domainsAligned(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// receivedHeader returns a Received: header field (RFC 5321, section 4.4)
+// for a message from the client with helo, hostname and ip (as returned by
+// clientIdentity), received by domain. The recipient is only included if
+// there is a single one, to not reveal the other recipients.
+//
+// go-smtp doesn't tell whether the client used HELO or EHLO, so the protocol
+// is always ESMTP, or ESMTPS with TLS.
+func receivedHeader(helo, hostname, ip, domain string, tls bool, rcpts []string, now time.Time) string {
+	protocol := "ESMTP"
+	if tls {
+		protocol = "ESMTPS"
+	}
+	if strings.HasPrefix(hostname, "[") {
+		hostname = "unknown"
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Received: from %s (%s [%s])\r\n", helo, hostname, ip)
+	fmt.Fprintf(b, "\tby %s (willi) with %s", domain, protocol)
+	if len(rcpts) == 1 {
+		fmt.Fprintf(b, "\r\n\tfor <%s>", rcpts[0])
+	}
+	fmt.Fprintf(b, "; %s\r\n", now.Format(time.RFC1123Z))
+
+	return b.String()
+}
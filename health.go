@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// healthRecheckInterval is the time between upstream checks while a failed
+// check keeps willi from being ready, see check_upstream_on_start.
+const healthRecheckInterval = 10 * time.Second
+
+// Health tracks whether willi should receive clients, for load balancers and
+// orchestrators, see health_listen.
+type Health struct {
+	listening  atomic.Bool // the listener accepts clients
+	upstreamOk atomic.Bool // check_upstream_on_start passed or is off
+	draining   atomic.Bool // shutting down
+}
+
+func (h *Health) Ready() bool {
+	return h.listening.Load() && h.upstreamOk.Load() && !h.draining.Load()
+}
+
+// recheckUpstreams repeats the upstream check until it succeeds, so a failed
+// check at startup doesn't keep willi unready forever.
+func (h *Health) recheckUpstreams(config *Config, resolver *Resolver) {
+	for !h.draining.Load() {
+		time.Sleep(healthRecheckInterval)
+		if checkUpstreams(config, resolver) {
+			log.Info("Upstream server check succeeded, ready")
+			h.upstreamOk.Store(true)
+			return
+		}
+	}
+}
+
+// healthHandler serves the liveness (/healthz) and readiness (/readyz)
+// endpoints.
+func healthHandler(h *Health) http.Handler {
+	mux := http.NewServeMux()
+
+	// /healthz succeeds as long as the process is running.
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+
+	// /readyz succeeds once clients are accepted, and fails again as soon as
+	// willi shuts down.
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !h.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ready\n"))
+	})
+
+	return mux
+}
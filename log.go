@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"regexp"
 	"strconv"
 	"sync"
 	"time"
@@ -11,6 +13,157 @@ import (
 	log "github.com/inconshreveable/log15"
 )
 
+// componentKey is the context key that tags log records with the subsystem
+// they come from, see ComponentLvlFilterHandler.
+const componentKey = "component"
+
+// ComponentLvlFilterHandler passes records up to the level configured for
+// their component (the value of the "component" context key). Records of
+// other components and records without a component are filtered with lvl.
+// A record can be tagged more than once, e.g. when a session's logger logs a
+// DNS lookup: the last component counts, the others are dropped from it.
+func ComponentLvlFilterHandler(lvl log.Lvl, levels map[string]log.Lvl, h log.Handler) log.Handler {
+	return log.FuncHandler(func(r *log.Record) error {
+		component, shadowed := -1, false // index of the last component key in r.Ctx
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			if r.Ctx[i] == componentKey {
+				shadowed = component >= 0
+				component = i
+			}
+		}
+
+		max := lvl
+		if component >= 0 {
+			if c, ok := r.Ctx[component+1].(string); ok {
+				if l, ok := levels[c]; ok {
+					max = l
+				}
+			}
+		}
+		if r.Lvl > max {
+			return nil
+		}
+
+		if shadowed {
+			tagged := *r
+			tagged.Ctx = make([]interface{}, 0, len(r.Ctx))
+			for i := 0; i+1 < len(r.Ctx); i += 2 {
+				if r.Ctx[i] != componentKey || i == component {
+					tagged.Ctx = append(tagged.Ctx, r.Ctx[i], r.Ctx[i+1])
+				}
+			}
+			r = &tagged
+		}
+		return h.Log(r)
+	})
+}
+
+// RedactingFormat replaces all matches of patterns in the message and the
+// context values of log records with "<redacted>" before they are formatted
+// with format, so the result is still valid logfmt or JSON. Values are matched
+// in the form they are logged in, keys aren't redacted.
+func RedactingFormat(format log.Format, patterns []*regexp.Regexp) log.Format {
+	if len(patterns) == 0 {
+		return format
+	}
+
+	redact := func(s string) string {
+		for _, pattern := range patterns {
+			s = pattern.ReplaceAllLiteralString(s, "<redacted>")
+		}
+		return s
+	}
+
+	return log.FormatFunc(func(r *log.Record) []byte {
+		redacted := *r
+		redacted.Msg = redact(r.Msg)
+		redacted.Ctx = make([]interface{}, len(r.Ctx))
+		for i, value := range r.Ctx {
+			if i%2 == 1 {
+				value = redactValue(value, redact)
+			}
+			redacted.Ctx[i] = value
+		}
+		return format.Format(&redacted)
+	})
+}
+
+// redactValue applies redact to the string form of value. Numbers and bools
+// are only turned into strings if something was redacted.
+func redactValue(value interface{}, redact func(string) string) interface{} {
+	if value == nil {
+		return value
+	}
+	if _, ok := value.(time.Time); ok {
+		return value
+	}
+
+	value = formatShared(value)
+	switch v := value.(type) {
+	case string:
+		return redact(v)
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		s := fmt.Sprint(v)
+		if r := redact(s); r != s {
+			return r
+		}
+		return v
+	default:
+		return redact(fmt.Sprintf("%+v", value))
+	}
+}
+
+// JsonFormatFlat formats log records as one JSON object per line, with the
+// time in key "t" if timestamps is true. Unlike log15's JsonFormat, values are never nested: numbers
+// and bools are kept, everything else is formatted like in logfmt (errors with
+// Error(), Stringers with String(), other values with %+v) and becomes a
+// string. HTML characters are not escaped, so "<redacted>" stays readable.
+func JsonFormatFlat(timestamps bool) log.Format {
+	return log.FormatFunc(func(r *log.Record) []byte {
+		props := make(map[string]interface{}, 3+len(r.Ctx)/2)
+		if timestamps {
+			props[r.KeyNames.Time] = r.Time.Format(timeFormat)
+		}
+		props[r.KeyNames.Lvl] = r.Lvl.String()
+		props[r.KeyNames.Msg] = r.Msg
+
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			k, ok := r.Ctx[i].(string)
+			if !ok {
+				props[errorKey] = fmt.Sprintf("%+v is not a string key", r.Ctx[i])
+				continue
+			}
+			props[k] = formatJsonValue(r.Ctx[i+1])
+		}
+
+		buf := &bytes.Buffer{}
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(props); err != nil {
+			buf.Reset()
+			enc.Encode(map[string]string{errorKey: err.Error()})
+		}
+		return buf.Bytes()
+	})
+}
+
+func formatJsonValue(value interface{}) interface{} {
+	if value == nil {
+		return "nil"
+	}
+
+	if t, ok := value.(time.Time); ok {
+		return t.Format(timeFormat)
+	}
+	value = formatShared(value)
+	switch v := value.(type) {
+	case bool, string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	default:
+		return fmt.Sprintf("%+v", value)
+	}
+}
+
 // 1:1 copy of functions from log15
 //
 // The single change: Don't include timestamp in log message
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+)
+
+func TestRedactingFormat(t *testing.T) {
+	config := loadTestConfig(t,
+		`mappings: [{"type": "static", "server": "127.0.0.1:25"}]`,
+		`log_redact_patterns: ["[a-z0-9.]+@secret\\.example\\.com", "\\b(?:\\d[ -]?){13,16}\\b"]`)
+	patterns := make([]*regexp.Regexp, len(config.LogRedactPatterns))
+	for i, pattern := range config.LogRedactPatterns {
+		patterns[i] = pattern.Regexp
+	}
+
+	for _, format := range []struct {
+		name   string
+		format log.Format
+	}{
+		{"logfmt", LogfmtFormatWithoutTimestamp()},
+		{"json", JsonFormatFlat(false)},
+	} {
+		var buf bytes.Buffer
+		logger := log.New()
+		logger.SetHandler(log.StreamHandler(&buf, RedactingFormat(format.format, patterns)))
+
+		logger.Info("Mail from alice@secret.example.com", "from", "alice@secret.example.com",
+			"header_subject", "card 4111 1111 1111 1111", "card", 4111111111111111, "rcpts", 2,
+			"rcpt", "bob@example.org", "error", errors.New("user bob@secret.example.com unknown"))
+		line := buf.String()
+
+		for _, secret := range []string{"secret.example.com", "4111"} {
+			if strings.Contains(line, secret) {
+				t.Errorf("%s: %q contains %s", format.name, line, secret)
+			}
+		}
+		for _, want := range []string{"bob@example.org", "user <redacted> unknown", "card <redacted>"} {
+			if !strings.Contains(line, want) {
+				t.Errorf("%s: %q doesn't contain %s", format.name, line, want)
+			}
+		}
+
+		if format.name == "json" {
+			var record map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("redacted JSON %q: %v", line, err)
+			}
+			if record["card"] != "<redacted>" || record["rcpts"] != 2.0 {
+				t.Errorf("got card %#v and rcpts %#v, want only the matching number redacted",
+					record["card"], record["rcpts"])
+			}
+		}
+	}
+
+	_, err := loadConfigLines(t, `mappings: [{"type": "static", "server": "127.0.0.1:25"}]`,
+		`log_redact_patterns: ["(unclosed"]`)
+	if err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+func TestComponentLogLevels(t *testing.T) {
+	config := loadTestConfig(t,
+		`mappings: [{"type": "static", "server": "127.0.0.1:25"}]`,
+		`loglevel: info`,
+		`log_levels: {"mapping": "debug", "proxy": "warn"}`)
+
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetHandler(logHandler(config, &buf))
+	session := logger.New("sid", "S1", componentKey, "proxy")
+
+	logger.Debug("raised", componentKey, "mapping")
+	logger.Info("lowered", componentKey, "proxy")
+	session.Warn("lowered but severe enough")
+	session.Debug("raised in a session", componentKey, "mapping")
+	logger.Info("untagged")
+	logger.Debug("untagged debug")
+	logger.Debug("other component", componentKey, "dns")
+
+	got := strings.TrimSpace(buf.String())
+	want := strings.Join([]string{
+		`lvl=dbug msg=raised component=mapping`,
+		`lvl=warn msg="lowered but severe enough" sid=S1 component=proxy`,
+		`lvl=dbug msg="raised in a session" sid=S1 component=mapping`,
+		`lvl=info msg=untagged`,
+	}, "\n")
+	if got != want {
+		t.Errorf("got log lines\n%s\nwant\n%s", got, want)
+	}
+}
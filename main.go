@@ -4,9 +4,15 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/emersion/go-smtp"
@@ -14,7 +20,7 @@ import (
 )
 
 var (
-	configFileFlag = flag.String("c", "willi.conf", "Path to configuration file")
+	configFileFlag = flag.String("c", "willi.conf", "Path to configuration file, empty to configure by environment only")
 	versionFlag    = flag.Bool("V", false, "Print version and exit")
 	version        = "undefined" // updated during release build
 )
@@ -29,51 +35,266 @@ func main() {
 		os.Exit(0)
 	}
 
-	fmt.Fprintf(os.Stderr, "Loading config file %s\n", *configFileFlag)
+	if *configFileFlag != "" {
+		fmt.Fprintf(os.Stderr, "Loading config file %s\n", *configFileFlag)
+	}
 	config, err := loadConfigFile(*configFileFlag)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to load config file %s: %v\n", *configFileFlag, err)
+		if *configFileFlag != "" {
+			fmt.Fprintf(os.Stderr, "Failed to load config file %s: %v\n", *configFileFlag, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		}
 		os.Exit(1)
 	}
 
-	log.Root().SetHandler(
-		log.LvlFilterHandler(log.Lvl(config.LogLevel),
-			log.StreamHandler(os.Stdout, LogfmtFormatWithoutTimestamp())))
+	setupLogging(config)
 
 	log.Info("Starting willi", "version", version)
 
-	for _, mapping := range config.Mappings {
-		log.Info("Using mapping", "mapping", mapping)
+	logConfig(config)
+
+	tlsConfig, err := loadTlsCertificates(config)
+	if err != nil {
+		log.Error("Failed to load TLS key/cert", "error", err)
+		os.Exit(1)
+	}
+
+	if config.Acme != nil {
+		m := newAcmeManager(config.Acme)
+		serveAuxiliary("acme", config.Acme.HttpListen, m.HTTPHandler(nil), config.AuxiliaryBindFatal)
+
+		tlsConfig = &tls.Config{
+			GetCertificate: acmeCertificate(m, config.Acme.Domains),
+			NextProtos:     config.TlsAlpn,
+		}
+		applyTlsVersions(tlsConfig, config)
+	}
+
+	if err := requireClientCerts(tlsConfig, config); err != nil {
+		log.Error("Failed to load client CA certificates", "error", err)
+		os.Exit(1)
+	}
+
+	loggers := NewSessionLoggers()
+
+	if tlsConfig != nil && len(config.TlsServerNames) > 0 {
+		tlsConfig.GetConfigForClient = serverNameFilter(config.TlsServerNames, loggers)
+	}
+
+	be := newBackend(config, loggers)
+
+	health := &Health{}
+	health.upstreamOk.Store(true)
+	if config.HealthListen != "" {
+		serveAuxiliary("health", config.HealthListen, healthHandler(health), config.AuxiliaryBindFatal)
+	}
+
+	if config.CheckUpstreamOnStart != "off" && !checkUpstreams(config, be.opts.resolver) {
+		if config.CheckUpstreamOnStart == "strict" {
+			log.Error("Upstream server check failed, exiting (check_upstream_on_start is strict)")
+			os.Exit(1)
+		}
+		if config.HealthListen != "" {
+			health.upstreamOk.Store(false)
+			go health.recheckUpstreams(config, be.opts.resolver)
+		}
 	}
 
-	var tlsConfig *tls.Config
-	if config.TlsCert != "" && config.TlsKey != "" {
-		cer, err := tls.LoadX509KeyPair(config.TlsCert, config.TlsKey)
-		if err != nil {
-			log.Error("Failed to load TLS key/cert", "error", err)
+	log.Info("Starting server", "address", config.Listen)
+	s, l, err := newServer(config, be, loggers, tlsConfig)
+	if err != nil {
+		log.Error("Failed to start server", "error", err)
+		os.Exit(1)
+	}
+
+	if config.DebugListen != "" {
+		serveAuxiliary("debug", config.DebugListen, debugHandler(be, l), config.AuxiliaryBindFatal)
+	}
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Serve(l)
+	}()
+	health.listening.Store(true)
+
+loop:
+	for {
+		select {
+		case err := <-errs:
+			log.Error("Server failed", "error", err)
 			os.Exit(1)
+		case <-reload:
+			reloadConfig(be)
+		case sig := <-terminate:
+			config = be.Config()
+			log.Info("Shutting down", "signal", sig, "timeout", time.Duration(config.ShutdownTimeout))
+			break loop
 		}
+	}
+
+	shutdown(config, s, l, be, health)
 
-		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cer}}
+	log.Info("Stopped willi")
+}
+
+// shutdown stops s gracefully: load balancers are given health_drain_delay to
+// notice, then no more clients are accepted and active sessions get
+// shutdown_timeout to finish. Sessions are closed with a 421 reply at their
+// next command boundary outside of a transaction, those still open after the
+// timeout are disconnected.
+func shutdown(config *Config, s *smtp.Server, l *SessionListener, be *ProxyBackend, health *Health) {
+	// Let load balancers notice that willi is going away before the listener
+	// closes
+	health.draining.Store(true)
+	if config.HealthListen != "" && config.HealthDrainDelay > 0 {
+		log.Info("Waiting for load balancers to stop sending clients", "delay",
+			time.Duration(config.HealthDrainDelay))
+		time.Sleep(time.Duration(config.HealthDrainDelay))
+	}
+
+	// Stop accepting connections and let active sessions finish. Sessions that
+	// start a new transaction receive a 421 and are disconnected, idle ones
+	// right away.
+	be.draining.Store(true)
+	if err := l.Close(); err != nil {
+		log.Warn("Failed to close listener", "error", err)
+	}
+
+	stop := make(chan struct{})
+	go be.closeIdleSessions(s, stop)
+	if !l.Wait(time.Duration(config.ShutdownTimeout)) {
+		log.Warn("Shutdown timeout reached, closing remaining connections")
+	}
+	close(stop)
+	s.Close()
+
+	if be.pool != nil {
+		be.pool.Close()
 	}
 
-	loggers := &SessionLoggers{
-		loggers: make(map[net.Addr]log.Logger),
+	if be.accounting != nil && !be.accounting.Close(accountingShutdownTimeout) {
+		log.Warn("Accounting records not sent before shutdown were lost")
 	}
+}
+
+// serveAuxiliary serves handler on address in the background. If address can't
+// be bound, willi exits if fatal is set and continues without the server
+// otherwise, see auxiliary_bind_fatal.
+func serveAuxiliary(name string, address string, handler http.Handler, fatal bool) {
+	log.Info("Starting "+name+" server", "address", address)
 
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		if fatal {
+			log.Error("Failed to start "+name+" server", "error", err)
+			os.Exit(1)
+		}
+		log.Warn("Failed to start "+name+" server, continuing without it", "error", err)
+		return
+	}
+
+	go func() {
+		if err := http.Serve(l, handler); err != nil {
+			log.Error("HTTP server failed", "server", name, "error", err)
+		}
+	}()
+}
+
+func setupLogging(config *Config) {
+	log.Root().SetHandler(logHandler(config, os.Stdout))
+}
+
+// logHandler returns the handler that writes the log of config to w.
+func logHandler(config *Config, w io.Writer) log.Handler {
+	logLevels := make(map[string]log.Lvl, len(config.LogLevels))
+	for component, lvl := range config.LogLevels {
+		logLevels[component] = log.Lvl(lvl)
+	}
+
+	// Slow operations are logged even if loglevel is error, unless the "slow"
+	// component is configured explicitly
+	if _, ok := logLevels["slow"]; !ok && config.SlowLogThreshold > 0 {
+		logLevels["slow"] = log.LvlWarn
+	}
+
+	redactPatterns := make([]*regexp.Regexp, len(config.LogRedactPatterns))
+	for i, pattern := range config.LogRedactPatterns {
+		redactPatterns[i] = pattern.Regexp
+	}
+
+	format := LogfmtFormatWithoutTimestamp()
+	switch {
+	case config.LogFormat == "json":
+		format = JsonFormatFlat(config.LogTimestamps)
+	case config.LogTimestamps:
+		format = log.LogfmtFormat()
+	}
+
+	return ComponentLvlFilterHandler(log.Lvl(config.LogLevel), logLevels,
+		log.StreamHandler(w, RedactingFormat(format, redactPatterns)))
+}
+
+func logConfig(config *Config) {
+	for _, key := range config.UnknownKeys {
+		log.Warn("Ignoring unknown config key", "key", key)
+	}
+
+	for _, mapping := range config.Mappings {
+		log.Info("Using mapping", "mapping", mapping)
+	}
+}
+
+// newBackend sets up the backend for config, including the state that is kept
+// across reloads: the upstream connection pool, the deduplication cache and
+// accounting.
+func newBackend(config *Config, loggers *SessionLoggers) *ProxyBackend {
 	be := &ProxyBackend{
+		sessions: &sync.WaitGroup{},
 		loggers:  loggers,
-		domain:   config.Domain,
-		mappings: config.Mappings,
 
-		recipientDelimiter: config.RecipientDelimiter,
+		upstreamErrors: NewUpstreamErrors(config.UpstreamErrorHistory),
 	}
+	be.configure(config)
+
+	if config.MaxIdlePerUpstream > 0 {
+		reapInterval := time.Duration(config.PoolReapInterval)
+		if reapInterval == 0 {
+			reapInterval = time.Duration(config.IdleTimeout) / 2
+		}
+		be.pool = NewUpstreamPool(config.MaxIdlePerUpstream, time.Duration(config.IdleTimeout), reapInterval)
+		if config.MinIdlePerUpstream > 0 {
+			be.pool.WarmUp(config.MinIdlePerUpstream, be.warmUpTargets)
+		}
+	}
+
+	if config.DedupWindow > 0 {
+		be.dedup = NewDedupCache(time.Duration(config.DedupWindow))
+	}
+
+	if config.AccountingUrl != "" {
+		be.accounting = NewAccounting(config.AccountingUrl)
+	}
+
+	return be
+}
+
+// newServer sets up the SMTP server for be and opens its listener. tlsConfig
+// is nil if TLS isn't configured.
+func newServer(config *Config, be *ProxyBackend, loggers *SessionLoggers, tlsConfig *tls.Config) (*smtp.Server,
+	*SessionListener, error) {
 
 	s := smtp.NewServer(be)
 
 	s.Addr = config.Listen
 	s.Domain = config.Domain
-	s.ReadTimeout = time.Duration(config.ReadTimeout)
+	s.ReadTimeout = time.Duration(config.CommandTimeout)
 	s.WriteTimeout = time.Duration(config.WriteTimeout)
 	s.MaxMessageBytes = int(config.MaxMessageBytes)
 	s.MaxRecipients = config.MaxRecipients
@@ -81,14 +302,45 @@ func main() {
 	s.AuthDisabled = true
 	s.TLSConfig = tlsConfig
 
-	log.Info("Starting server", "address", s.Addr)
-	if err := ListenAndServe(s, loggers); err != nil {
-		log.Error("Failed to start server", "error", err)
-		os.Exit(1)
+	l, err := Listen(s, loggers, config.ProxyProtocol)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.logCommandQuirks = config.LogCommandQuirks
+	l.SetLimits(ConnLimits{
+		Max:           config.MaxConnections,
+		PerIP:         config.MaxConnectionsPerIp,
+		RatePerMinute: config.ConnectionRatePerMinute,
+		Action:        config.ConnLimitAction,
+		Domain:        s.Domain,
+	})
+
+	return s, l, nil
+}
+
+// reloadConfig loads the config file again and applies it to new sessions. If
+// the file can't be loaded, the running config is kept.
+func reloadConfig(be *ProxyBackend) {
+	log.Info("Reloading config file", "file", *configFileFlag)
+
+	config, err := loadConfigFile(*configFileFlag)
+	if err != nil {
+		log.Error("Failed to reload config file, keeping the running config", "error", err)
+		return
+	}
+
+	for _, key := range keepRestartOptions(be.Config(), config) {
+		log.Warn("Ignoring changed config key, it needs a restart", "key", key)
 	}
+
+	setupLogging(config)
+	logConfig(config)
+	be.Reload(config)
+
+	log.Info("Reloaded config file")
 }
 
-func ListenAndServe(s *smtp.Server, loggers *SessionLoggers) error {
+func Listen(s *smtp.Server, loggers *SessionLoggers, proxyProtocol bool) (*SessionListener, error) {
 	network := "tcp"
 	if s.LMTP {
 		network = "unix"
@@ -101,8 +353,8 @@ func ListenAndServe(s *smtp.Server, loggers *SessionLoggers) error {
 
 	l, err := net.Listen(network, addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return s.Serve(&SessionListener{l: l, loggers: loggers})
+	return NewSessionListener(l, loggers, proxyProtocol), nil
 }
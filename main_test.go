@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	log "github.com/inconshreveable/log15"
+)
+
+// systemCA is trusted like the CAs of the system, for upstream servers with
+// tls_verify.
+var systemCA *testCA
+
+func TestMain(m *testing.M) {
+	log.Root().SetHandler(log.DiscardHandler())
+
+	// Go reads the system roots once, before the first verification
+	var err error
+	if systemCA, err = createCA(); err != nil {
+		panic(err)
+	}
+	dir, err := os.MkdirTemp("", "willi-test")
+	if err != nil {
+		panic(err)
+	}
+	file := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(file, systemCA.pem, 0600); err != nil {
+		panic(err)
+	}
+	os.Setenv("SSL_CERT_FILE", file)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fakeUpstream is an upstream SMTP server on a loopback listener. It accepts
+// everything and records the commands and messages it receives. Set the
+// fields before passing it to startUpstream.
+type fakeUpstream struct {
+	ext       []string    // EHLO keywords, e.g. "XFORWARD NAME ADDR"
+	tlsConfig *tls.Config // announces STARTTLS if set
+	smtps     bool        // implicit TLS with tlsConfig instead of STARTTLS
+	auth      string      // "user:password" accepted by AUTH PLAIN, announces AUTH if set
+	listen    string      // address to listen on, 127.0.0.1:0 if empty
+
+	l net.Listener
+
+	mu       sync.Mutex
+	conns    int
+	closed   int
+	commands []string
+	messages []string
+	hook     func(c *fakeConn, line string) bool
+}
+
+// fakeConn is a client connection of a fakeUpstream.
+type fakeConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *fakeConn) reply(lines ...string) {
+	for _, line := range lines {
+		io.WriteString(c, line+"\r\n")
+	}
+}
+
+// readData reads message content up to the final dot.
+func (c *fakeConn) readData() (string, error) {
+	var b strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return b.String(), err
+		}
+		if line == ".\r\n" {
+			return b.String(), nil
+		}
+		b.WriteString(strings.TrimPrefix(line, "."))
+	}
+}
+
+func startUpstream(t *testing.T, u *fakeUpstream) *fakeUpstream {
+	t.Helper()
+
+	if u.listen == "" {
+		u.listen = "127.0.0.1:0"
+	}
+	l, err := net.Listen("tcp", u.listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.l = l
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if u.smtps {
+				conn = tls.Server(conn, u.tlsConfig)
+			}
+			u.mu.Lock()
+			u.conns++
+			u.mu.Unlock()
+			go u.serve(&fakeConn{conn, bufio.NewReader(conn)})
+		}
+	}()
+
+	return u
+}
+
+func (u *fakeUpstream) addr() string {
+	return u.l.Addr().String()
+}
+
+// static returns the mappings of a config that sends everything to u.
+func (u *fakeUpstream) static(fields ...string) string {
+	return fmt.Sprintf(`mappings: [{"type": "static", "server": "%s", "tls_verify": false%s}]`, u.addr(),
+		strings.Join(append([]string{""}, fields...), ", "))
+}
+
+// setHook makes hook see each command line first. It returns true if it
+// handled the command.
+func (u *fakeUpstream) setHook(hook func(c *fakeConn, line string) bool) {
+	u.mu.Lock()
+	u.hook = hook
+	u.mu.Unlock()
+}
+
+func (u *fakeUpstream) connCount() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.conns
+}
+
+// closedCount returns the number of connections that have ended, with QUIT
+// or without.
+func (u *fakeUpstream) closedCount() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.closed
+}
+
+// received returns the command lines received so far, from all connections.
+func (u *fakeUpstream) received() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.commands...)
+}
+
+// verbs returns the commands received so far without their arguments.
+func (u *fakeUpstream) verbs() []string {
+	var verbs []string
+	for _, line := range u.received() {
+		verb, _, _ := strings.Cut(line, " ")
+		verbs = append(verbs, strings.ToUpper(verb))
+	}
+	return verbs
+}
+
+func (u *fakeUpstream) delivered() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.messages...)
+}
+
+func (u *fakeUpstream) serve(c *fakeConn) {
+	defer func() {
+		c.Close()
+		u.mu.Lock()
+		u.closed++
+		u.mu.Unlock()
+	}()
+
+	c.reply("220 upstream.test ESMTP")
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		u.mu.Lock()
+		u.commands = append(u.commands, line)
+		hook := u.hook
+		u.mu.Unlock()
+		if hook != nil && hook(c, line) {
+			continue
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			ext := append([]string{"upstream.test"}, u.ext...)
+			if _, isTls := c.Conn.(*tls.Conn); u.tlsConfig != nil && !isTls {
+				ext = append(ext, "STARTTLS")
+			}
+			if u.auth != "" {
+				ext = append(ext, "AUTH PLAIN")
+			}
+			for i, e := range ext {
+				sep := "-"
+				if i == len(ext)-1 {
+					sep = " "
+				}
+				c.reply("250" + sep + e)
+			}
+		case "STARTTLS":
+			c.reply("220 2.0.0 ready")
+			tlsConn := tls.Server(c.Conn, u.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			c.Conn = tlsConn
+			c.r = bufio.NewReader(tlsConn)
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			user, password, _ := strings.Cut(u.auth, ":")
+			if string(credentials) == "\x00"+user+"\x00"+password {
+				c.reply("235 2.7.0 authenticated")
+			} else {
+				c.reply("535 5.7.8 bad credentials")
+			}
+		case "DATA":
+			c.reply("354 go ahead")
+			msg, err := c.readData()
+			if err != nil {
+				return
+			}
+			u.mu.Lock()
+			u.messages = append(u.messages, msg)
+			u.mu.Unlock()
+			c.reply("250 2.0.0 queued")
+		case "QUIT":
+			c.reply("221 2.0.0 bye")
+			return
+		case "XCLIENT":
+			c.reply("220 upstream.test ESMTP")
+		default:
+			c.reply("250 2.0.0 ok")
+		}
+	}
+}
+
+// testProxy is willi set up like main does, listening on a loopback address.
+type testProxy struct {
+	config *Config
+	be     *ProxyBackend
+	s      *smtp.Server
+	l      *SessionListener
+	addr   string
+}
+
+// startProxy starts willi with the config given as lines of a config file.
+// It listens on a random port.
+func startProxy(t *testing.T, lines ...string) *testProxy {
+	t.Helper()
+
+	config := loadTestConfig(t, lines...)
+	config.Listen = "127.0.0.1:0"
+
+	tlsConfig, err := loadTlsCertificates(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := requireClientCerts(tlsConfig, config); err != nil {
+		t.Fatal(err)
+	}
+
+	loggers := NewSessionLoggers()
+	if tlsConfig != nil && len(config.TlsServerNames) > 0 {
+		tlsConfig.GetConfigForClient = serverNameFilter(config.TlsServerNames, loggers)
+	}
+
+	be := newBackend(config, loggers)
+	s, l, err := newServer(config, be, loggers, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	t.Cleanup(func() {
+		s.Close()
+		if be.pool != nil {
+			be.pool.Close()
+		}
+	})
+
+	return &testProxy{config, be, s, l, l.Addr().String()}
+}
+
+// loadTestConfig loads the config given as lines of a config file.
+func loadTestConfig(t *testing.T, lines ...string) *Config {
+	t.Helper()
+
+	config, err := loadConfigLines(t, lines...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func loadConfigLines(t *testing.T, lines ...string) (*Config, error) {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "willi.conf")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfigFile(file)
+	if err == nil {
+		t.Cleanup(func() { closeMappings(config.Mappings) })
+	}
+	return config, err
+}
+
+// dial connects an SMTP client to p and sends EHLO.
+func (p *testProxy) dial(t *testing.T) *smtp.Client {
+	t.Helper()
+
+	c, err := smtpDial(p.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// smtpDial connects an SMTP client to addr and sends EHLO, for use outside of
+// the test's goroutine.
+func smtpDial(addr string) (*smtp.Client, error) {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Hello("client.test"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// sendMail sends a message with a client that is already greeted. It
+// returns the first error.
+func sendMail(c *smtp.Client, from string, rcpts []string, msg string) error {
+	if err := c.Mail(from, nil); err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+const testMessage = "From: <sender@example.com>\r\nTo: <rcpt@example.org>\r\nSubject: test\r\n\r\nHello\r\n"
+
+// rawClient talks to willi line by line, for what the SMTP client can't do.
+type rawClient struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+// dialRaw connects a rawClient to p and reads the greeting.
+func (p *testProxy) dialRaw(t *testing.T) *rawClient {
+	t.Helper()
+
+	c, err := net.Dial("tcp", p.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	rc := &rawClient{t, c, bufio.NewReader(c)}
+	rc.read()
+	return rc
+}
+
+// read returns the next reply, all lines joined with newlines. A closed
+// connection is returned as "EOF".
+func (rc *rawClient) read() string {
+	rc.t.Helper()
+
+	rc.c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var lines []string
+	for {
+		line, err := rc.r.ReadString('\n')
+		if err == io.EOF && line == "" && len(lines) == 0 {
+			return "EOF"
+		}
+		if err != nil {
+			rc.t.Fatalf("reading reply: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if len(line) < 4 || line[3] != '-' {
+			return strings.Join(lines, "\n")
+		}
+	}
+}
+
+// cmd sends line and returns the reply.
+func (rc *rawClient) cmd(line string) string {
+	rc.t.Helper()
+
+	rc.send(line + "\r\n")
+	return rc.read()
+}
+
+func (rc *rawClient) send(s string) {
+	rc.t.Helper()
+
+	if _, err := io.WriteString(rc.c, s); err != nil {
+		rc.t.Fatal(err)
+	}
+}
+
+// expectCode fails the test unless reply starts with code.
+func expectCode(t *testing.T, reply string, code string) {
+	t.Helper()
+
+	if !strings.HasPrefix(reply, code) {
+		t.Fatalf("got reply %q, want %s", reply, code)
+	}
+}
+
+// expectSMTPCode fails the test unless err is an SMTP reply with code.
+func expectSMTPCode(t *testing.T, err error, code int) {
+	t.Helper()
+
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code != code {
+		t.Fatalf("got error %v, want SMTP reply %d", err, code)
+	}
+}
+
+// eventually waits up to 5s for cond to become true.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// logBuffer collects the log output in logfmt.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// lines returns the log lines that contain all of substrings.
+func (b *logBuffer) lines(substrings ...string) []string {
+	var lines []string
+next:
+	for _, line := range strings.Split(b.String(), "\n") {
+		for _, s := range substrings {
+			if !strings.Contains(line, s) {
+				continue next
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// captureLogs collects all log records up to debug level until the test ends.
+func captureLogs(t *testing.T) *logBuffer {
+	b := &logBuffer{}
+	log.Root().SetHandler(log.StreamHandler(b, LogfmtFormatWithoutTimestamp()))
+	t.Cleanup(func() { log.Root().SetHandler(log.DiscardHandler()) })
+	return b
+}
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	ca, err := createCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func createCA() (*testCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}, nil
+}
+
+// issue returns a certificate for cn, valid for 127.0.0.1 and localhost as
+// server and as client.
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	return ca.issueWith(t, cn, nil)
+}
+
+// issueWith is like issue, but modify may change the certificate first.
+func (ca *testCA) issueWith(t *testing.T, cn string, modify func(*x509.Certificate)) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if modify != nil {
+		modify(template)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCertFiles writes cert and its key as PEM files and returns their paths.
+func writeCertFiles(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}))
+	return certFile, keyFile
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuxiliaryBindFailure(t *testing.T) {
+	// The fatal case exits, so it runs in a child process
+	if addr := os.Getenv("WILLI_TEST_AUXILIARY_FATAL"); addr != "" {
+		serveAuxiliary("health", addr, http.NotFoundHandler(), true)
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	logs := captureLogs(t)
+	serveAuxiliary("health", addr, http.NotFoundHandler(), false)
+	if len(logs.lines("lvl=warn", `msg="Failed to start health server, continuing without it"`)) != 1 {
+		t.Error("bind failure not logged")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAuxiliaryBindFailure$")
+	cmd.Env = append(os.Environ(), "WILLI_TEST_AUXILIARY_FATAL="+addr)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Errorf("got %v with auxiliary_bind_fatal, want exit code 1: %s", err, out)
+	}
+}
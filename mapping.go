@@ -1,32 +1,115 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	units "github.com/docker/go-units"
+	"github.com/go-ldap/ldap/v3"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/gomodule/redigo/redis"
+	log "github.com/inconshreveable/log15"
 	"github.com/jmoiron/sqlx"
+	"gopkg.in/yaml.v3"
 )
 
 var ErrNoUpstreamFound = errors.New("No server found for key")
 
+// TlsMode defines how the connection to an upstream server is encrypted.
+type TlsMode string
+
+const (
+	TlsModeDefault  TlsMode = ""         // not set by the mapping, upstream_tls_mode applies
+	TlsModeAuto     TlsMode = "auto"     // STARTTLS if the client used TLS and the upstream supports it
+	TlsModeNone     TlsMode = "none"     // never encrypt
+	TlsModeStarttls TlsMode = "starttls" // always STARTTLS, fail if the upstream doesn't support it
+	TlsModeSmtps    TlsMode = "smtps"    // implicit TLS (port 465 by default)
+)
+
+func ParseTlsMode(s string) (TlsMode, error) {
+	switch m := TlsMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case TlsModeDefault, TlsModeAuto, TlsModeNone, TlsModeStarttls, TlsModeSmtps:
+		return m, nil
+	default:
+		return "", fmt.Errorf("must be one of 'auto', 'none', 'starttls', 'smtps' but was '%s'", s)
+	}
+}
+
+func (m *TlsMode) UnmarshalText(b []byte) error {
+	x, err := ParseTlsMode(string(b))
+	if err != nil {
+		return err
+	}
+	*m = x
+	return nil
+}
+
+// ParseTlsPin parses the SHA-256 fingerprint of a certificate, given as 64 hex
+// digits, optionally separated by colons. It returns the fingerprint as
+// lowercase hex without colons.
+func ParseTlsPin(s string) (string, error) {
+	pin := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+	if b, err := hex.DecodeString(pin); err != nil || len(b) != 32 {
+		return "", fmt.Errorf("must be a SHA-256 fingerprint (64 hex digits) but was '%s'", s)
+	}
+	return pin, nil
+}
+
 type Upstream struct {
 	Server    string
 	TlsVerify bool
+	TlsMode   TlsMode
+	TlsPin    string // SHA-256 fingerprint of the certificate, replaces verification if set
+
+	MaxMessageBytes int // 0 means no upstream specific limit
+
+	// Credentials willi authenticates with (AUTH PLAIN) to the upstream
+	// server, if AuthUser is set
+	AuthUser     string
+	AuthPassword string
 }
 
 func (u *Upstream) String() string {
-	verified := "tls unverified"
+	parts := []string{u.Server, "tls unverified"}
 	if u.TlsVerify {
-		verified = "tls verified"
+		parts[1] = "tls verified"
+	}
+	if u.TlsMode != TlsModeDefault {
+		parts = append(parts, string(u.TlsMode))
+	}
+	if u.TlsPin != "" {
+		parts = append(parts, "pinned "+u.TlsPin)
+	}
+	if u.MaxMessageBytes > 0 {
+		parts = append(parts, "max "+units.BytesSize(float64(u.MaxMessageBytes)))
 	}
-	return fmt.Sprintf("{%s, %s}", u.Server, verified)
+	if u.AuthUser != "" {
+		parts = append(parts, "auth "+u.AuthUser+":<redacted>")
+	}
+	return fmt.Sprintf("{%s}", strings.Join(parts, ", "))
+}
+
+// checkUpstreamAuth makes sure that auth_user and auth_password of an upstream
+// server are either both set or both empty.
+func checkUpstreamAuth(user string, password string) error {
+	if (user == "") != (password == "") {
+		return fmt.Errorf("auth_user and auth_password must be set together")
+	}
+	return nil
 }
 
 type Mapping interface {
@@ -37,12 +120,8 @@ type staticMapping struct {
 	server Upstream
 }
 
-func NewStaticMapping(server string, tlsVerify bool) (Mapping, error) {
-	return &staticMapping{
-		server: Upstream{
-			Server:    server,
-			TlsVerify: tlsVerify,
-		}}, nil
+func NewStaticMapping(server Upstream) (Mapping, error) {
+	return &staticMapping{server: server}, nil
 }
 
 func (m *staticMapping) Get(key string) (Upstream, error) {
@@ -53,20 +132,81 @@ func (m *staticMapping) String() string {
 	return fmt.Sprintf("{static, %s}", &m.server)
 }
 
-type csvMapping struct {
+// fileMappingMinInterval is the shortest reload_interval of a file mapping.
+const fileMappingMinInterval = 1 * time.Second
+
+// fileMapping holds the entries of a CSV, JSON or YAML file in memory.
+type fileMapping struct {
+	filename string
+	format   string // "csv", "json" or "yaml"
+	read     func(filename string) (map[string]Upstream, time.Time, error)
+	interval time.Duration // 0 if the file isn't watched
+
+	mu      sync.RWMutex // guards servers and modTime, which are replaced on reload
 	servers map[string]Upstream
+	modTime time.Time
+
+	stop chan struct{}
+	once sync.Once
 }
 
-func NewCSVMapping(filename string) (Mapping, error) {
-	f, err := os.Open(filename)
+// NewCSVMapping reads filename. If reloadInterval isn't 0, the file is checked
+// for changes at that interval and read again if its modification time
+// changed. If it can't be read then, the previous entries are kept.
+func NewCSVMapping(filename string, reloadInterval time.Duration) (Mapping, error) {
+	return newFileMapping(filename, "csv", readCSVMapping, reloadInterval)
+}
+
+// NewJSONMapping reads filename, a JSON object that maps keys to objects with
+// the fields of an upstream server, see NewCSVMapping.
+func NewJSONMapping(filename string, reloadInterval time.Duration) (Mapping, error) {
+	return newFileMapping(filename, "json", readJSONMapping, reloadInterval)
+}
+
+// NewYAMLMapping reads filename, a YAML mapping of keys to mappings with the
+// fields of an upstream server, see NewCSVMapping.
+func NewYAMLMapping(filename string, reloadInterval time.Duration) (Mapping, error) {
+	return newFileMapping(filename, "yaml", readYAMLMapping, reloadInterval)
+}
+
+func newFileMapping(filename string, format string,
+	read func(string) (map[string]Upstream, time.Time, error), reloadInterval time.Duration) (Mapping, error) {
+	servers, modTime, err := read(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	mapping := &csvMapping{
-		servers: make(map[string]Upstream, 0),
+	mapping := &fileMapping{
+		filename: filename,
+		format:   format,
+		read:     read,
+		interval: reloadInterval,
+		servers:  servers,
+		modTime:  modTime,
+		stop:     make(chan struct{}),
+	}
+
+	if reloadInterval > 0 {
+		go mapping.watch()
 	}
 
+	return mapping, nil
+}
+
+func readCSVMapping(filename string) (map[string]Upstream, time.Time, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	servers := make(map[string]Upstream, 0)
+
 	r := csv.NewReader(f)
 	r.Comma = ';'
 	r.Comment = '#'
@@ -74,18 +214,28 @@ func NewCSVMapping(filename string) (Mapping, error) {
 
 	// skip first line (column headers)
 	if _, err := r.Read(); err != nil {
-		return nil, err
+		return nil, time.Time{}, err
 	}
 
 	// read the rest
-	records, err := r.ReadAll()
-	if err != nil {
-		return nil, err
-	}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, time.Time{}, err
+		}
 
-	for _, record := range records {
+		line, _ := r.FieldPos(0)
+		if len(record) < 2 {
+			return nil, time.Time{}, fmt.Errorf("line %d: expected at least 2 fields", line)
+		}
 		key := strings.TrimSpace(record[0])
 		server := strings.TrimSpace(record[1])
+		if key == "" || server == "" {
+			return nil, time.Time{}, fmt.Errorf("line %d: key and server must not be empty", line)
+		}
 
 		t := "true"
 		if len(record) > 2 {
@@ -94,19 +244,255 @@ func NewCSVMapping(filename string) (Mapping, error) {
 
 		tlsVerify, err := strconv.ParseBool(t)
 		if err != nil {
-			return nil, fmt.Errorf("tls_verify: %w", err)
+			return nil, time.Time{}, fmt.Errorf("tls_verify: %w", err)
+		}
+
+		var maxMessageBytes int64
+		if len(record) > 3 && strings.TrimSpace(record[3]) != "" {
+			maxMessageBytes, err = units.FromHumanSize(strings.TrimSpace(record[3]))
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("max_message_bytes: %w", err)
+			}
+		}
+
+		var tlsMode TlsMode
+		if len(record) > 4 {
+			tlsMode, err = ParseTlsMode(record[4])
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("tls_mode: %w", err)
+			}
 		}
 
-		mapping.servers[key] = Upstream{
+		var tlsPin string
+		if len(record) > 5 && strings.TrimSpace(record[5]) != "" {
+			tlsPin, err = ParseTlsPin(record[5])
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("tls_pin: %w", err)
+			}
+		}
+
+		// The password is taken as is, it may start or end with spaces. A user
+		// without a password column is rejected by checkUpstreamAuth.
+		var authUser, authPassword string
+		if len(record) > 6 {
+			authUser = strings.TrimSpace(record[6])
+		}
+		if len(record) > 7 {
+			authPassword = record[7]
+		}
+		if err := checkUpstreamAuth(authUser, authPassword); err != nil {
+			return nil, time.Time{}, fmt.Errorf("key '%s': %w", key, err)
+		}
+
+		servers[key] = Upstream{
 			Server:    server,
 			TlsVerify: tlsVerify,
+			TlsMode:   tlsMode,
+			TlsPin:    tlsPin,
+
+			MaxMessageBytes: int(maxMessageBytes),
+
+			AuthUser:     authUser,
+			AuthPassword: authPassword,
 		}
 	}
 
-	return mapping, nil
+	return servers, fi.ModTime(), nil
 }
 
-func (m *csvMapping) Get(key string) (Upstream, error) {
+// readMappingFile returns the content and modification time of filename.
+func readMappingFile(filename string) ([]byte, time.Time, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return data, fi.ModTime(), nil
+}
+
+func readJSONMapping(filename string) (map[string]Upstream, time.Time, error) {
+	data, modTime, err := readMappingFile(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// Decoded token by token, as encoding/json silently keeps the last of
+	// duplicate keys
+	d := json.NewDecoder(bytes.NewReader(data))
+	line := func() int { return 1 + bytes.Count(data[:d.InputOffset()], []byte("\n")) }
+	syntaxError := func(err error) error {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return fmt.Errorf("line %d: %w", 1+bytes.Count(data[:syntaxErr.Offset], []byte("\n")), err)
+		}
+		return err
+	}
+
+	if t, err := d.Token(); err != nil {
+		return nil, time.Time{}, syntaxError(err)
+	} else if t != json.Delim('{') {
+		return nil, time.Time{}, fmt.Errorf("line %d: expected an object of keys to upstream servers", line())
+	}
+
+	servers := make(map[string]Upstream)
+	lines := make(map[string]int)
+
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, time.Time{}, syntaxError(err)
+		}
+		key := t.(string)
+		keyLine := line()
+
+		if first, ok := lines[key]; ok {
+			return nil, time.Time{}, fmt.Errorf("line %d: duplicate key '%s', first defined on line %d", keyLine,
+				key, first)
+		}
+
+		var entry map[string]interface{}
+		if err := d.Decode(&entry); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				return nil, time.Time{}, syntaxError(err)
+			}
+			return nil, time.Time{}, fmt.Errorf("line %d: key '%s': %w", keyLine, key, err)
+		}
+
+		upstream, err := parseUpstreamEntry(entry)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("line %d: key '%s': %w", keyLine, key, err)
+		}
+
+		servers[key] = upstream
+		lines[key] = keyLine
+	}
+
+	if _, err := d.Token(); err != nil {
+		return nil, time.Time{}, syntaxError(err)
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, time.Time{}, fmt.Errorf("line %d: unexpected data after the object", line())
+	}
+
+	return servers, modTime, nil
+}
+
+func readYAMLMapping(filename string) (map[string]Upstream, time.Time, error) {
+	data, modTime, err := readMappingFile(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	servers := make(map[string]Upstream)
+	if len(doc.Content) == 0 {
+		return servers, modTime, nil // empty file
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, time.Time{}, fmt.Errorf("line %d: expected a mapping of keys to upstream servers", root.Line)
+	}
+
+	// yaml.v3 doesn't check for duplicate keys when decoding into a Node
+	lines := make(map[string]int)
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i].Value, root.Content[i+1]
+		keyLine := root.Content[i].Line
+
+		if first, ok := lines[key]; ok {
+			return nil, time.Time{}, fmt.Errorf("line %d: duplicate key '%s', first defined on line %d", keyLine,
+				key, first)
+		}
+
+		var entry map[string]interface{}
+		if err := value.Decode(&entry); err != nil {
+			return nil, time.Time{}, fmt.Errorf("line %d: key '%s': %w", keyLine, key, err)
+		}
+
+		upstream, err := parseUpstreamEntry(entry)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("line %d: key '%s': %w", keyLine, key, err)
+		}
+
+		servers[key] = upstream
+		lines[key] = keyLine
+	}
+
+	return servers, modTime, nil
+}
+
+func (m *fileMapping) watch() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.reload()
+		}
+	}
+}
+
+// reload reads the file again if its modification time changed.
+func (m *fileMapping) reload() {
+	fi, err := os.Stat(m.filename)
+	if err != nil {
+		log.Error("Failed to check mapping file, keeping the previous entries", componentKey, "mapping",
+			"file", m.filename, "error", err)
+		return
+	}
+
+	m.mu.RLock()
+	changed := !fi.ModTime().Equal(m.modTime)
+	m.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	servers, modTime, err := m.read(m.filename)
+	if err != nil {
+		log.Error("Failed to reload mapping file, keeping the previous entries", componentKey, "mapping",
+			"file", m.filename, "error", err)
+
+		// Don't log the same error again until the file changes
+		m.mu.Lock()
+		m.modTime = fi.ModTime()
+		m.mu.Unlock()
+		return
+	}
+
+	m.mu.Lock()
+	m.servers = servers
+	m.modTime = modTime
+	m.mu.Unlock()
+
+	log.Info("Reloaded mapping file", componentKey, "mapping", "file", m.filename, "entries", len(servers))
+}
+
+func (m *fileMapping) Get(key string) (Upstream, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	if server, ok := m.servers[key]; ok {
 		return server, nil
 	}
@@ -114,8 +500,19 @@ func (m *csvMapping) Get(key string) (Upstream, error) {
 	return Upstream{}, ErrNoUpstreamFound
 }
 
-func (m *csvMapping) String() string {
-	return fmt.Sprintf("{csv, %d entries}", len(m.servers))
+func (m *fileMapping) Close() error {
+	m.once.Do(func() { close(m.stop) })
+	return nil
+}
+
+func (m *fileMapping) String() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.interval > 0 {
+		return fmt.Sprintf("{%s, %d entries, reload interval %s}", m.format, len(m.servers), m.interval)
+	}
+	return fmt.Sprintf("{%s, %d entries}", m.format, len(m.servers))
 }
 
 type sqlMapping struct {
@@ -162,12 +559,99 @@ func (b *dbbool) Scan(src interface{}) error {
 	return nil
 }
 
+type dbsize int
+
+func (s *dbsize) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*s = 0
+	case int64:
+		*s = dbsize(v)
+	case []uint8:
+		x, err := units.FromHumanSize(string(v))
+		if err != nil {
+			return err
+		}
+		*s = dbsize(x)
+	default:
+		return fmt.Errorf("expected a size but got %T", src)
+	}
+
+	return nil
+}
+
+type dbtlsmode TlsMode
+
+func (m *dbtlsmode) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = dbtlsmode(TlsModeDefault)
+	case []uint8:
+		x, err := ParseTlsMode(string(v))
+		if err != nil {
+			return err
+		}
+		*m = dbtlsmode(x)
+	default:
+		return fmt.Errorf("expected a TLS mode but got %T", src)
+	}
+
+	return nil
+}
+
+type dbtlspin string
+
+func (p *dbtlspin) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*p = ""
+	case []uint8:
+		if len(v) == 0 {
+			*p = ""
+			return nil
+		}
+		x, err := ParseTlsPin(string(v))
+		if err != nil {
+			return err
+		}
+		*p = dbtlspin(x)
+	default:
+		return fmt.Errorf("expected a fingerprint but got %T", src)
+	}
+
+	return nil
+}
+
+type dbstring string
+
+func (s *dbstring) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*s = ""
+	case []uint8:
+		*s = dbstring(v)
+	case string:
+		*s = dbstring(v)
+	default:
+		return fmt.Errorf("expected a string but got %T", src)
+	}
+
+	return nil
+}
+
 func (m *sqlMapping) Get(key string) (Upstream, error) {
 	res := m.db.QueryRowx(m.query, key)
 
 	row := struct {
-		Server    string `db:"server"`
-		TlsVerify dbbool `db:"tls_verify"`
+		Server    string    `db:"server"`
+		TlsVerify dbbool    `db:"tls_verify"`
+		TlsMode   dbtlsmode `db:"tls_mode"`
+		TlsPin    dbtlspin  `db:"tls_pin"`
+
+		MaxMessageBytes dbsize `db:"max_message_bytes"`
+
+		AuthUser     dbstring `db:"auth_user"`
+		AuthPassword dbstring `db:"auth_password"`
 	}{
 		Server:    "",
 		TlsVerify: dbbool(true),
@@ -180,13 +664,312 @@ func (m *sqlMapping) Get(key string) (Upstream, error) {
 	if err != nil {
 		return Upstream{}, err
 	}
+	if err := checkUpstreamAuth(string(row.AuthUser), string(row.AuthPassword)); err != nil {
+		return Upstream{}, err
+	}
 
 	return Upstream{
 		Server:    row.Server,
 		TlsVerify: bool(row.TlsVerify),
+		TlsMode:   TlsMode(row.TlsMode),
+		TlsPin:    string(row.TlsPin),
+
+		MaxMessageBytes: int(row.MaxMessageBytes),
+
+		AuthUser:     string(row.AuthUser),
+		AuthPassword: string(row.AuthPassword),
 	}, nil
 }
 
+func (m *sqlMapping) Close() error {
+	return m.db.Close()
+}
+
 func (m *sqlMapping) String() string {
 	return fmt.Sprintf("{%s, %s, '%s'}", m.driverName, m.redactedDsn, m.query)
 }
+
+// ldapTimeout limits connecting to the LDAP server and each request.
+const ldapTimeout = 10 * time.Second
+
+type ldapMapping struct {
+	url           string
+	bindDn        string
+	bindPassword  string
+	baseDn        string
+	filter        string // '%s' is replaced by the escaped key
+	serverAttr    string
+	tlsVerifyAttr string
+	authUserAttr  string
+	authPassAttr  string
+
+	mu   sync.Mutex // guards conn, which is reused across lookups
+	conn *ldap.Conn
+}
+
+func NewLDAPMapping(url string, bindDn string, bindPassword string, baseDn string, filter string,
+	serverAttr string, tlsVerifyAttr string, authUserAttr string, authPassAttr string) (Mapping, error) {
+
+	if !strings.Contains(filter, "%s") {
+		return nil, fmt.Errorf("filter '%s' doesn't contain '%%s'", filter)
+	}
+	if _, err := ldap.CompileFilter(strings.ReplaceAll(filter, "%s", "x")); err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+
+	return &ldapMapping{
+		url:           url,
+		bindDn:        bindDn,
+		bindPassword:  bindPassword,
+		baseDn:        baseDn,
+		filter:        filter,
+		serverAttr:    serverAttr,
+		tlsVerifyAttr: tlsVerifyAttr,
+		authUserAttr:  authUserAttr,
+		authPassAttr:  authPassAttr,
+	}, nil
+}
+
+// connect returns the current connection or opens and binds a new one. Must
+// be called with mu held.
+func (m *ldapMapping) connect() (*ldap.Conn, error) {
+	if m.conn != nil && !m.conn.IsClosing() {
+		return m.conn, nil
+	}
+
+	conn, err := ldap.DialURL(m.url, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if m.bindDn != "" {
+		if err := conn.Bind(m.bindDn, m.bindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	m.conn = conn
+	return conn, nil
+}
+
+func (m *ldapMapping) search(key string) (*ldap.SearchResult, error) {
+	conn, err := m.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []string{m.serverAttr}
+	if m.tlsVerifyAttr != "" {
+		attrs = append(attrs, m.tlsVerifyAttr)
+	}
+	if m.authUserAttr != "" {
+		attrs = append(attrs, m.authUserAttr, m.authPassAttr)
+	}
+	req := ldap.NewSearchRequest(m.baseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		strings.ReplaceAll(m.filter, "%s", ldap.EscapeFilter(key)), attrs, nil)
+
+	res, err := conn.Search(req)
+	if err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		conn.Close()
+		m.conn = nil
+	}
+	return res, err
+}
+
+func (m *ldapMapping) Get(key string) (Upstream, error) {
+	m.mu.Lock()
+	reused := m.conn != nil
+	res, err := m.search(key)
+	if err != nil && reused && m.conn == nil {
+		// The server may have closed the idle connection, retry once with a
+		// new one
+		res, err = m.search(key)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return Upstream{}, err
+	}
+
+	// If multiple entries are returned, only the first one will be used
+	if len(res.Entries) == 0 {
+		return Upstream{}, ErrNoUpstreamFound
+	}
+	entry := res.Entries[0]
+
+	server := entry.GetAttributeValue(m.serverAttr)
+	if server == "" {
+		return Upstream{}, fmt.Errorf("entry '%s' has no attribute '%s'", entry.DN, m.serverAttr)
+	}
+
+	tlsVerify := dbbool(true)
+	if v := entry.GetAttributeValue(m.tlsVerifyAttr); m.tlsVerifyAttr != "" && v != "" {
+		if err := tlsVerify.Scan([]uint8(v)); err != nil {
+			return Upstream{}, fmt.Errorf("entry '%s': %s: %w", entry.DN, m.tlsVerifyAttr, err)
+		}
+	}
+
+	var authUser, authPassword string
+	if m.authUserAttr != "" {
+		authUser = entry.GetAttributeValue(m.authUserAttr)
+		authPassword = entry.GetAttributeValue(m.authPassAttr)
+		if err := checkUpstreamAuth(authUser, authPassword); err != nil {
+			return Upstream{}, fmt.Errorf("entry '%s': %w", entry.DN, err)
+		}
+	}
+
+	return Upstream{
+		Server:    server,
+		TlsVerify: bool(tlsVerify),
+
+		AuthUser:     authUser,
+		AuthPassword: authPassword,
+	}, nil
+}
+
+func (m *ldapMapping) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+	return nil
+}
+
+func (m *ldapMapping) String() string {
+	return fmt.Sprintf("{ldap, %s, %s:<redacted>, %s, '%s'}", m.url, m.bindDn, m.baseDn, m.filter)
+}
+
+// redisTimeout limits connecting to the Redis server and each request.
+const redisTimeout = 5 * time.Second
+
+// redisMaxIdle is the number of idle connections kept for reuse.
+const redisMaxIdle = 10
+
+type redisMapping struct {
+	redactedUrl string
+	prefix      string
+
+	pool *redis.Pool
+}
+
+// NewRedisMapping looks up keys in the Redis server at rawUrl
+// (redis://[:password@]host[:port][/db] or rediss:// for TLS). The key
+// looked up is prefix followed by the lookup key. Connections are pooled and
+// only opened on the first lookup.
+func NewRedisMapping(rawUrl string, prefix string) (Mapping, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, fmt.Errorf("url must be a redis:// or rediss:// URL")
+	}
+
+	pool := &redis.Pool{
+		MaxIdle:     redisMaxIdle,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(rawUrl, redis.DialConnectTimeout(redisTimeout),
+				redis.DialReadTimeout(redisTimeout), redis.DialWriteTimeout(redisTimeout))
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			// The server may have closed a connection that was idle for long
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+
+	redacted := u.Redacted()
+	if _, ok := u.User.Password(); ok {
+		redacted = strings.Replace(redacted, ":xxxxx@", ":<redacted>@", 1)
+	}
+
+	return &redisMapping{redacted, prefix, pool}, nil
+}
+
+// Get reads the hash at the key, whose fields are those of a SQL mapping
+// (server, tls_verify, ...). A string at the key is the server, with the
+// certificate verified.
+func (m *redisMapping) Get(key string) (Upstream, error) {
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	fields, err := redis.StringMap(conn.Do("HGETALL", m.prefix+key))
+	if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		server, err := redis.String(conn.Do("GET", m.prefix+key))
+		if err != nil {
+			return Upstream{}, err
+		}
+		return Upstream{Server: server, TlsVerify: true}, nil
+	}
+	if err != nil {
+		return Upstream{}, err
+	}
+
+	// Redis doesn't store empty hashes, so the key doesn't exist
+	if len(fields) == 0 {
+		return Upstream{}, ErrNoUpstreamFound
+	}
+
+	server := fields["server"]
+	if server == "" {
+		return Upstream{}, fmt.Errorf("key '%s' has no field 'server'", m.prefix+key)
+	}
+
+	tlsVerify := dbbool(true)
+	if v, ok := fields["tls_verify"]; ok {
+		if err := tlsVerify.Scan([]uint8(v)); err != nil {
+			return Upstream{}, fmt.Errorf("key '%s': tls_verify: %w", m.prefix+key, err)
+		}
+	}
+
+	var tlsMode dbtlsmode
+	if v, ok := fields["tls_mode"]; ok {
+		if err := tlsMode.Scan([]uint8(v)); err != nil {
+			return Upstream{}, fmt.Errorf("key '%s': tls_mode: %w", m.prefix+key, err)
+		}
+	}
+
+	var tlsPin dbtlspin
+	if v, ok := fields["tls_pin"]; ok {
+		if err := tlsPin.Scan([]uint8(v)); err != nil {
+			return Upstream{}, fmt.Errorf("key '%s': tls_pin: %w", m.prefix+key, err)
+		}
+	}
+
+	var maxMessageBytes dbsize
+	if v, ok := fields["max_message_bytes"]; ok && v != "" {
+		if err := maxMessageBytes.Scan([]uint8(v)); err != nil {
+			return Upstream{}, fmt.Errorf("key '%s': max_message_bytes: %w", m.prefix+key, err)
+		}
+	}
+
+	authUser, authPassword := fields["auth_user"], fields["auth_password"]
+	if err := checkUpstreamAuth(authUser, authPassword); err != nil {
+		return Upstream{}, fmt.Errorf("key '%s': %w", m.prefix+key, err)
+	}
+
+	return Upstream{
+		Server:    server,
+		TlsVerify: bool(tlsVerify),
+		TlsMode:   TlsMode(tlsMode),
+		TlsPin:    string(tlsPin),
+
+		MaxMessageBytes: int(maxMessageBytes),
+
+		AuthUser:     authUser,
+		AuthPassword: authPassword,
+	}, nil
+}
+
+func (m *redisMapping) Close() error {
+	return m.pool.Close()
+}
+
+func (m *redisMapping) String() string {
+	return fmt.Sprintf("{redis, %s, prefix '%s'}", m.redactedUrl, m.prefix)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSVMappingReload(t *testing.T) {
+	logs := captureLogs(t)
+	table := filepath.Join(t.TempDir(), "mapping.csv")
+	modTime := time.Now().Add(-time.Hour)
+	update := func(content string) {
+		t.Helper()
+
+		writeFile(t, table, []byte(content))
+		modTime = modTime.Add(time.Minute) // the file may change within the resolution of its mtime
+		if err := os.Chtimes(table, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update("pattern;server\nexample.com;mail.example.com\n")
+	m, err := NewCSVMapping(table, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.(*fileMapping).Close()
+
+	// A broken file doesn't replace the entries that were read before
+	update("pattern;server\nexample.com\n")
+	eventually(t, "failed reload", func() bool {
+		return len(logs.lines("Failed to reload mapping file", "line 2")) > 0
+	})
+	if upstream, err := m.Get("example.com"); err != nil || upstream.Server != "mail.example.com" {
+		t.Errorf("got %v, %v after a failed reload, want the previous entry", upstream, err)
+	}
+
+	update("pattern;server\nexample.com;mx.example.com\n")
+	eventually(t, "reload", func() bool {
+		upstream, err := m.Get("example.com")
+		return err == nil && upstream.Server == "mx.example.com"
+	})
+}
+
+func TestCSVMappingInvalidLines(t *testing.T) {
+	for _, line := range []string{"example.com", " ;mail.example.com", "example.com; "} {
+		table := filepath.Join(t.TempDir(), "mapping.csv")
+		writeFile(t, table, []byte("pattern;server\n"+line+"\n"))
+
+		_, _, err := readCSVMapping(table)
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("got error %v for %q, want one for line 2", err, line)
+		}
+	}
+}
+
+func TestCSVMappingAuthWithoutPassword(t *testing.T) {
+	table := filepath.Join(t.TempDir(), "mapping.csv")
+	writeFile(t, table, []byte("pattern;server;tls_verify;max_message_bytes;tls_mode;tls_pin;auth_user\n"+
+		"example.com;mail.example.com;true;;;;relay\n"))
+
+	_, _, err := readCSVMapping(table)
+	if err == nil || !strings.Contains(err.Error(), "auth_password") {
+		t.Errorf("got error %v, want auth_user without auth_password rejected", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// cachingMapping remembers the results of another mapping, see
+// mapping_cache_ttl. Misses (ErrNoUpstreamFound) are remembered for
+// negativeTtl, so new entries show up sooner. Other errors are not cached. Once
+// the cache holds size entries, the least recently used one is evicted.
+type cachingMapping struct {
+	mapping     Mapping
+	ttl         time.Duration
+	negativeTtl time.Duration
+	size        int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+	hits    uint64
+	misses  uint64
+}
+
+type cacheEntry struct {
+	key      string
+	upstream Upstream
+	err      error // nil or ErrNoUpstreamFound
+	expires  time.Time
+}
+
+// MappingCacheStats are the numbers of a cachingMapping since it was created.
+type MappingCacheStats struct {
+	Mapping string `json:"mapping"`
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// mappingType returns the type of mapping for logs and errors. Caches are
+// transparent.
+func mappingType(mapping Mapping) string {
+	if c, ok := mapping.(*cachingMapping); ok {
+		mapping = c.mapping
+	}
+	return fmt.Sprintf("%T", mapping)
+}
+
+func NewCachingMapping(mapping Mapping, ttl time.Duration, negativeTtl time.Duration, size int) Mapping {
+	if negativeTtl > ttl {
+		negativeTtl = ttl
+	}
+
+	return &cachingMapping{
+		mapping:     mapping,
+		ttl:         ttl,
+		negativeTtl: negativeTtl,
+		size:        size,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+func (m *cachingMapping) Get(key string) (Upstream, error) {
+	if upstream, err, ok := m.cached(key); ok {
+		return upstream, err
+	}
+
+	upstream, err := m.mapping.Get(key)
+	if err != nil && err != ErrNoUpstreamFound {
+		return upstream, err
+	}
+
+	ttl := m.ttl
+	if err == ErrNoUpstreamFound {
+		ttl = m.negativeTtl
+	}
+	if ttl > 0 {
+		m.add(&cacheEntry{key: key, upstream: upstream, err: err, expires: time.Now().Add(ttl)})
+	}
+
+	return upstream, err
+}
+
+// cached returns the unexpired entry for key, if any, and counts the lookup
+// as hit or miss.
+func (m *cachingMapping) cached(key string) (Upstream, error, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			m.lru.MoveToFront(e)
+			m.hits++
+			return entry.upstream, entry.err, true
+		}
+		m.remove(e)
+	}
+
+	m.misses++
+	return Upstream{}, nil, false
+}
+
+func (m *cachingMapping) add(entry *cacheEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Concurrent lookups of the same key may both have missed
+	if e, ok := m.entries[entry.key]; ok {
+		m.remove(e)
+	}
+
+	m.entries[entry.key] = m.lru.PushFront(entry)
+	for m.lru.Len() > m.size {
+		m.remove(m.lru.Back())
+	}
+}
+
+func (m *cachingMapping) remove(e *list.Element) {
+	delete(m.entries, e.Value.(*cacheEntry).key)
+	m.lru.Remove(e)
+}
+
+func (m *cachingMapping) Stats() MappingCacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return MappingCacheStats{
+		Mapping: fmt.Sprint(m.mapping),
+		Entries: m.lru.Len(),
+		Hits:    m.hits,
+		Misses:  m.misses,
+	}
+}
+
+func (m *cachingMapping) Close() error {
+	stats := m.Stats()
+	log.Info("Closing mapping cache", componentKey, "mapping", "mapping", m.mapping, "hits", stats.Hits,
+		"misses", stats.Misses)
+
+	if c, ok := m.mapping.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (m *cachingMapping) String() string {
+	return fmt.Sprintf("{cache, ttl %s, negative ttl %s, %d entries max, %s}", m.ttl, m.negativeTtl, m.size,
+		m.mapping)
+}
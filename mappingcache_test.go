@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingMapping maps keys starting with "known" to a server named like the
+// key, fails for "broken" and counts the lookups.
+type countingMapping struct {
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func (m *countingMapping) Get(key string) (Upstream, error) {
+	m.mu.Lock()
+	m.lookups[key]++
+	m.mu.Unlock()
+
+	switch {
+	case key == "broken":
+		return Upstream{}, errors.New("database unavailable")
+	case len(key) >= 5 && key[:5] == "known":
+		return Upstream{Server: key + ":25"}, nil
+	}
+	return Upstream{}, ErrNoUpstreamFound
+}
+
+func (m *countingMapping) count(key string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lookups[key]
+}
+
+func TestCachingMapping(t *testing.T) {
+	backend := &countingMapping{lookups: map[string]int{}}
+	m := NewCachingMapping(backend, 300*time.Millisecond, 100*time.Millisecond, 2).(*cachingMapping)
+
+	for i := 0; i < 3; i++ {
+		if upstream, err := m.Get("known1"); err != nil || upstream.Server != "known1:25" {
+			t.Fatalf("got %v, %v", upstream, err)
+		}
+		if _, err := m.Get("unknown"); err != ErrNoUpstreamFound {
+			t.Fatalf("got %v, want ErrNoUpstreamFound", err)
+		}
+		if _, err := m.Get("broken"); err == nil || err == ErrNoUpstreamFound {
+			t.Fatalf("got %v, want the error of the mapping", err)
+		}
+	}
+	if backend.count("known1") != 1 || backend.count("unknown") != 1 || backend.count("broken") != 3 {
+		t.Errorf("got lookups %v, want only errors looked up each time", backend.lookups)
+	}
+	if stats := m.Stats(); stats.Hits != 4 || stats.Misses != 5 || stats.Entries != 2 {
+		t.Errorf("got %+v, want 4 hits, 5 misses and 2 entries", stats)
+	}
+
+	// Misses expire first
+	time.Sleep(150 * time.Millisecond)
+	m.Get("known1")
+	m.Get("unknown")
+	if backend.count("known1") != 1 || backend.count("unknown") != 2 {
+		t.Errorf("got lookups %v after the negative TTL, want only the miss looked up again", backend.lookups)
+	}
+	time.Sleep(200 * time.Millisecond)
+	m.Get("known1")
+	if backend.count("known1") != 2 {
+		t.Errorf("got %d lookups after the TTL, want 2", backend.count("known1"))
+	}
+
+	// The least recently used entry is evicted: known1 was used after unknown
+	m.Get("known2")
+	m.Get("known1")
+	m.Get("unknown")
+	if backend.count("known1") != 2 || backend.count("known2") != 1 || backend.count("unknown") != 3 {
+		t.Errorf("got lookups %v, want the least recently used entry evicted", backend.lookups)
+	}
+
+	// Concurrent lookups, for the race detector
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Get(fmt.Sprintf("known%d", (i+j)%4))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if stats := m.Stats(); stats.Entries != 2 || stats.Hits+stats.Misses != 15+800 {
+		t.Errorf("got %+v after concurrent lookups", stats)
+	}
+}
+
+func TestMappingCacheConfig(t *testing.T) {
+	config := loadTestConfig(t,
+		"mappings: [",
+		`  {"type": "static", "server": "127.0.0.1:25"}`,
+		`  {"type": "ldap", "ldap_url": "ldap://127.0.0.1:389", "base_dn": "dc=example", "filter": "(mail=%s)", "server_attr": "mailHost"}`,
+		"]",
+		"mapping_cache_ttl: 5m",
+		"mapping_cache_negative_ttl: 10m",
+		"mapping_cache_size: 50")
+
+	if _, ok := config.Mappings[0].(*cachingMapping); ok {
+		t.Error("static mapping cached")
+	}
+	cache, ok := config.Mappings[1].(*cachingMapping)
+	if !ok {
+		t.Fatalf("got %T, want the LDAP mapping cached", config.Mappings[1])
+	}
+	if cache.ttl != 5*time.Minute || cache.negativeTtl != 5*time.Minute || cache.size != 50 {
+		t.Errorf("got %s, want the negative TTL limited to the TTL", cache)
+	}
+	if mappingType(cache) != "*main.ldapMapping" {
+		t.Errorf("got type %s, want the cached mapping's", mappingType(cache))
+	}
+
+	_, err := loadConfigLines(t, `mappings: [{"type": "static", "server": "127.0.0.1:25"}]`,
+		"mapping_cache_ttl: 5m", "mapping_cache_size: 0")
+	if err == nil {
+		t.Error("mapping_cache_size 0 accepted")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	log "github.com/inconshreveable/log15"
+)
+
+// poolCheckTimeout limits the RSET that checks a pooled connection before it
+// is reused.
+const poolCheckTimeout = 5 * time.Second
+
+// UpstreamPool keeps idle connections to upstream servers for reuse by later
+// transactions. Connections are keyed by everything that was negotiated
+// before the first transaction: server, TLS mode and verification.
+type UpstreamPool struct {
+	mu           sync.Mutex
+	maxIdle      int
+	idleTimeout  time.Duration
+	reapInterval time.Duration
+	idle         map[string][]*pooledConn
+	closed       bool
+	stop         chan struct{}
+	reaped       sync.WaitGroup // done when the reaper has stopped
+
+	minIdle int
+	targets func() map[string]dialFunc // see WarmUp
+	warmNow chan struct{}              // makes the reaper warm up right away
+}
+
+// dialFunc opens a new connection for the pool.
+type dialFunc func() (*pooledConn, error)
+
+type pooledConn struct {
+	client *smtp.Client
+	conn   net.Conn
+	addr   string
+	tls    bool
+	since  time.Time
+}
+
+// NewUpstreamPool creates a pool of up to maxIdle connections per key. Unless
+// idleTimeout is 0, connections idle for longer are closed by a reaper every
+// reapInterval, and in any case before they would be reused. The reaper also
+// does the warm-up, see WarmUp.
+func NewUpstreamPool(maxIdle int, idleTimeout time.Duration, reapInterval time.Duration) *UpstreamPool {
+	p := &UpstreamPool{
+		maxIdle:      maxIdle,
+		idleTimeout:  idleTimeout,
+		reapInterval: reapInterval,
+		idle:         make(map[string][]*pooledConn),
+		stop:         make(chan struct{}),
+		warmNow:      make(chan struct{}, 1),
+	}
+
+	if reapInterval > 0 {
+		p.reaped.Add(1)
+		go p.reap()
+	}
+
+	return p
+}
+
+// Get returns a working idle connection for key, most recently used first.
+// Connections that fail the RSET check are closed and skipped.
+func (p *UpstreamPool) Get(key string) (*pooledConn, bool) {
+	for {
+		pc, ok := p.take(key)
+		if !ok {
+			return nil, false
+		}
+
+		timeout := pc.client.CommandTimeout
+		pc.client.CommandTimeout = poolCheckTimeout
+		err := pc.client.Reset()
+		pc.client.CommandTimeout = timeout
+		if err == nil {
+			return pc, true
+		}
+
+		log.Debug("Discarding broken pooled upstream connection", componentKey, "upstream", "upstream", key,
+			"error", err)
+		pc.client.Close()
+	}
+}
+
+func (p *UpstreamPool) take(key string) (*pooledConn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for list := p.idle[key]; len(list) > 0; list = p.idle[key] {
+		pc := list[len(list)-1]
+		p.idle[key] = list[:len(list)-1]
+
+		if p.idleTimeout <= 0 || time.Since(pc.since) < p.idleTimeout {
+			return pc, true
+		}
+		go closePooled(pc)
+	}
+
+	return nil, false
+}
+
+// Put returns a connection to the pool. It reports false if the pool for key
+// is full, the caller must close the connection then.
+func (p *UpstreamPool) Put(key string, pc *pooledConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle[key]) >= p.maxIdle {
+		return false
+	}
+
+	pc.since = time.Now()
+	p.idle[key] = append(p.idle[key], pc)
+
+	return true
+}
+
+// WarmUp makes the reaper keep at least minIdle idle connections for each key
+// returned by targets, dialing the missing ones with the key's dialFunc. The
+// connections idle the longest, up to minIdle, are checked with NOOP instead
+// of expiring after idleTimeout. The first warm-up starts right away. Must be
+// called at most once and requires a reapInterval.
+func (p *UpstreamPool) WarmUp(minIdle int, targets func() map[string]dialFunc) {
+	p.mu.Lock()
+	p.minIdle = minIdle
+	p.targets = targets
+	p.mu.Unlock()
+
+	p.warmNow <- struct{}{}
+}
+
+// warm checks and tops up the idle connections of all warm-up targets. It
+// gives up early if the pool is closed.
+func (p *UpstreamPool) warm() {
+	p.mu.Lock()
+	minIdle, targets := p.minIdle, p.targets
+	p.mu.Unlock()
+	if targets == nil {
+		return
+	}
+
+	for key, dial := range targets() {
+		for _, pc := range p.takeOldest(key, minIdle) {
+			timeout := pc.client.CommandTimeout
+			pc.client.CommandTimeout = poolCheckTimeout
+			err := pc.client.Noop()
+			pc.client.CommandTimeout = timeout
+			if err != nil {
+				log.Debug("Discarding broken warm upstream connection", componentKey, "upstream", "upstream", key,
+					"error", err)
+				pc.client.Close()
+			} else if !p.Put(key, pc) {
+				closePooled(pc)
+			}
+		}
+
+		for missing := minIdle - p.idleCount(key); missing > 0; missing-- {
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
+
+			pc, err := dial()
+			if err != nil {
+				log.Warn("Warming up upstream connection failed", componentKey, "upstream", "upstream", key,
+					"error", err)
+				break
+			}
+			if !p.Put(key, pc) {
+				closePooled(pc)
+				break
+			}
+		}
+	}
+}
+
+// takeOldest removes up to n of the connections for key that have been idle
+// the longest from the pool and returns them.
+func (p *UpstreamPool) takeOldest(key string, n int) []*pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := p.idle[key]
+	if n > len(list) {
+		n = len(list)
+	}
+	taken := append([]*pooledConn(nil), list[:n]...)
+	p.idle[key] = append(list[:0], list[n:]...)
+
+	return taken
+}
+
+func (p *UpstreamPool) idleCount(key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.idle[key])
+}
+
+// reap closes connections that have been idle for longer than idleTimeout and
+// does the warm-up, every reapInterval until the pool is closed.
+func (p *UpstreamPool) reap() {
+	defer p.reaped.Done()
+
+	t := time.NewTicker(p.reapInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.warmNow:
+			p.warm()
+			continue
+		case <-t.C:
+		}
+
+		p.warm()
+		for _, pc := range p.takeExpired() {
+			closePooled(pc)
+		}
+	}
+}
+
+// takeExpired removes the connections that have been idle for longer than
+// idleTimeout from the pool and returns them.
+func (p *UpstreamPool) takeExpired() []*pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.idleTimeout <= 0 {
+		return nil
+	}
+
+	var expired []*pooledConn
+	for key, list := range p.idle {
+		keep := list[:0]
+		for _, pc := range list {
+			if time.Since(pc.since) < p.idleTimeout {
+				keep = append(keep, pc)
+			} else {
+				expired = append(expired, pc)
+			}
+		}
+		p.idle[key] = keep
+	}
+
+	return expired
+}
+
+// Close stops the reaper and closes all idle connections. Connections put
+// afterwards are refused.
+func (p *UpstreamPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.stop)
+	p.mu.Unlock()
+
+	// The reaper may be closing connections it took from the pool
+	p.reaped.Wait()
+
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*pooledConn)
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, list := range idle {
+		for _, pc := range list {
+			wg.Add(1)
+			go func(pc *pooledConn) {
+				defer wg.Done()
+				closePooled(pc)
+			}(pc)
+		}
+	}
+	wg.Wait()
+}
+
+func closePooled(pc *pooledConn) {
+	pc.client.CommandTimeout = poolCheckTimeout
+	if err := pc.client.Quit(); err != nil {
+		pc.client.Close()
+	}
+}
+
+// warmUpTargets returns the pool keys of the upstream servers of the static
+// mappings, for min_idle_per_upstream, each with a function that dials a new
+// connection like a session would. In tls_mode auto, whether STARTTLS is used
+// depends on the client, so there is a key for clients with and one for
+// clients without TLS. With upstream_affinity client_ip, the keys depend on
+// the client IP, so nothing can be warmed up.
+func (b *ProxyBackend) warmUpTargets() map[string]dialFunc {
+	b.mu.RLock()
+	opts := b.opts
+	b.mu.RUnlock()
+
+	targets := make(map[string]dialFunc)
+	if opts.upstreamAffinity == "client_ip" {
+		return targets
+	}
+
+	for _, mapping := range opts.mappings {
+		static, ok := mapping.(*staticMapping)
+		if !ok {
+			continue
+		}
+
+		upstream := static.server
+		if upstream.TlsMode == TlsModeDefault {
+			upstream.TlsMode = opts.upstreamTlsMode
+		}
+		upstream.Server = upstreamAddress(upstream)
+
+		for _, clientTls := range []bool{false, true} {
+			if clientTls && upstream.TlsMode != TlsModeAuto {
+				continue
+			}
+
+			s := &ProxySession{log: log.Root(), sessionOptions: opts, backend: b, clientTls: clientTls,
+				helo: opts.domain}
+			targets[s.poolKey(upstream)] = func() (*pooledConn, error) {
+				s.msg = buildZeroProxyMessage()
+				s.msg.server = upstream.Server
+				if err := s.dial(upstream); err != nil {
+					if s.msg.client != nil {
+						s.msg.client.Close()
+					}
+					return nil, err
+				}
+				return &pooledConn{client: s.msg.client, conn: s.msg.conn, addr: s.msg.addr, tls: s.msg.tls}, nil
+			}
+		}
+	}
+
+	return targets
+}
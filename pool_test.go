@@ -0,0 +1,182 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// idleConns returns the number of idle connections in p.
+func idleConns(p *UpstreamPool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, list := range p.idle {
+		n += len(list)
+	}
+	return n
+}
+
+func TestPoolReusesConnection(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "max_idle_per_upstream: 2")
+
+	for i := 0; i < 2; i++ {
+		c := p.dial(t)
+		if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+		c.Quit()
+		eventually(t, "connection back in the pool", func() bool { return idleConns(p.be.pool) == 1 })
+	}
+
+	if n := up.connCount(); n != 1 {
+		t.Errorf("got %d upstream connections, want 1", n)
+	}
+	if n := len(up.delivered()); n != 2 {
+		t.Errorf("got %d messages upstream, want 2", n)
+	}
+
+	// The second transaction starts with RSET, which checks the connection
+	verbs := up.verbs()
+	want := []string{"EHLO", "MAIL", "RCPT", "DATA", "RSET", "MAIL", "RCPT", "DATA"}
+	if len(verbs) != len(want) {
+		t.Fatalf("got upstream commands %v, want %v", verbs, want)
+	}
+	for i := range want {
+		if verbs[i] != want[i] {
+			t.Fatalf("got upstream commands %v, want %v", verbs, want)
+		}
+	}
+}
+
+func TestPoolReplacesBrokenConnection(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "max_idle_per_upstream: 2")
+
+	c := p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	eventually(t, "connection back in the pool", func() bool { return idleConns(p.be.pool) == 1 })
+
+	// The pooled connection breaks while idle
+	up.setHook(func(c *fakeConn, line string) bool {
+		if line == "RSET" {
+			c.Close()
+			return true
+		}
+		return false
+	})
+
+	c = p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatalf("message after broken pooled connection: %v", err)
+	}
+
+	if n := up.connCount(); n != 2 {
+		t.Errorf("got %d upstream connections, want 2", n)
+	}
+	if n := len(up.delivered()); n != 2 {
+		t.Errorf("got %d messages upstream, want 2", n)
+	}
+}
+
+func TestPoolWarmUp(t *testing.T) {
+	// With tls_mode auto, there would be warm connections for plain and TLS
+	// clients each
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(`"tls_mode": "none"`), "max_idle_per_upstream: 3", "min_idle_per_upstream: 2",
+		"pool_reap_interval: 50ms")
+
+	// The connections are there before any client
+	eventually(t, "connections warmed up", func() bool { return idleConns(p.be.pool) == 2 })
+	if n := up.connCount(); n != 2 {
+		t.Errorf("got %d upstream connections, want 2", n)
+	}
+
+	// Warm connections are checked with NOOP
+	eventually(t, "idle connections checked", func() bool {
+		noops := 0
+		for _, verb := range up.verbs() {
+			if verb == "NOOP" {
+				noops++
+			}
+		}
+		return noops >= 2
+	})
+
+	// The check's short timeout isn't left for the transactions
+	p.be.pool.mu.Lock()
+	for _, list := range p.be.pool.idle {
+		for _, pc := range list {
+			if pc.client.CommandTimeout == poolCheckTimeout {
+				t.Error("checked connection kept the command timeout of the check")
+			}
+		}
+	}
+	p.be.pool.mu.Unlock()
+
+	c := p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(up.delivered()); n != 1 {
+		t.Errorf("got %d messages upstream, want 1", n)
+	}
+
+	// The client didn't wait for a new connection
+	if n := up.connCount(); n != 2 {
+		t.Errorf("got %d upstream connections, want 2", n)
+	}
+}
+
+func TestPoolReapsIdleConnections(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "max_idle_per_upstream: 2", "idle_timeout: 200ms",
+		"pool_reap_interval: 50ms")
+
+	c := p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	eventually(t, "connection back in the pool", func() bool { return idleConns(p.be.pool) == 1 })
+	idleSince := time.Now()
+
+	// Without any client, the connection is closed once it is idle for too long
+	eventually(t, "idle connection closed", func() bool { return up.closedCount() == 1 })
+	if d := time.Since(idleSince); d < 150*time.Millisecond {
+		t.Errorf("connection closed after %v, before the idle timeout", d)
+	}
+	if n := idleConns(p.be.pool); n != 0 {
+		t.Errorf("got %d idle connections, want 0", n)
+	}
+	if verbs := up.verbs(); verbs[len(verbs)-1] != "QUIT" {
+		t.Errorf("got upstream commands %v, want the connection closed with QUIT", verbs)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "max_idle_per_upstream: 2", "idle_timeout: 1m",
+		"pool_reap_interval: 1ms")
+
+	c := p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	eventually(t, "connection back in the pool", func() bool { return idleConns(p.be.pool) == 1 })
+
+	// Close stops the reaper and closes the idle connections before it returns
+	p.be.pool.Close()
+	if n := idleConns(p.be.pool); n != 0 {
+		t.Errorf("got %d idle connections after Close, want 0", n)
+	}
+	eventually(t, "idle connection closed", func() bool { return up.closedCount() == 1 })
+	if p.be.pool.Put("key", &pooledConn{}) {
+		t.Error("closed pool took a connection")
+	}
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"net/textproto"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/inconshreveable/log15"
 
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
@@ -22,6 +28,126 @@ var ErrRelayAccessDenied = &smtp.SMTPError{
 	Message:      "Relay access denied",
 }
 
+var ErrTooManyTransfers = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Too many concurrent transfers. Please try again later.",
+}
+
+var ErrMessageTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message size exceeds maximum permitted size",
+}
+
+var ErrHeaderTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message header exceeds maximum permitted size",
+}
+
+var ErrTooManyRcptErrors = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many invalid recipients",
+}
+
+var ErrTooManyTransactions = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many transactions in this connection",
+}
+
+var ErrDifferentUpstream = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Recipient is handled by a different server, please send it in a separate transaction",
+}
+
+var ErrTooManyConnectionRcpts = &smtp.SMTPError{
+	Code:         452,
+	EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+	Message:      "Too many recipients in this connection",
+}
+
+var ErrNoValidRecipients = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+	Message:      "No valid recipients",
+}
+
+var ErrFromNotAligned = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "From header does not match envelope sender",
+}
+
+var ErrSenderNotAllowed = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Sender address rejected: domain not allowed",
+}
+
+var ErrRecipientNotAllowed = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Recipient address rejected: domain not allowed",
+}
+
+var ErrSmtpUtf8Unsupported = &smtp.SMTPError{
+	Code:         553,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+	Message:      "SMTPUTF8 is not supported by the mail server of this recipient",
+}
+
+var ErrTooManyHops = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+	Message:      "Too many hops, mail loop detected",
+}
+
+var ErrDuplicateMessage = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Duplicate message",
+}
+
+var ErrUpstreamLostAfterData = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+	Message:      "Connection to upstream server lost. Please try again later.",
+}
+
+var ErrUpstreamProtocol = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 5, 0},
+	Message:      "Protocol error with upstream server. Please try again later.",
+}
+
+var ErrUpstreamTlsVerify = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 5},
+	Message:      "TLS certificate of upstream server could not be verified. Please try again later.",
+}
+
+var ErrChunkingTimeout = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+	Message:      "Timeout waiting for BDAT LAST. Please try again later.",
+}
+
+var ErrStarttlsRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Must issue a STARTTLS command first",
+}
+
+var ErrClientCertRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Must issue a STARTTLS command and authenticate with a client certificate first",
+}
+
 var ErrInternal = &smtp.SMTPError{
 	Code:         450,
 	EnhancedCode: smtp.NoEnhancedCode,
@@ -29,11 +155,77 @@ var ErrInternal = &smtp.SMTPError{
 }
 
 type ProxyBackend struct {
-	loggers  *SessionLoggers
+	mu       sync.RWMutex    // guards config, opts and sessions
+	config   *Config         // the config opts were built from
+	opts     *sessionOptions // options of new sessions, replaced as a whole by a reload
+	sessions *sync.WaitGroup // sessions created with the current options
+
+	loggers *SessionLoggers
+
+	dedup      *DedupCache   // nil if duplicates are not detected
+	pool       *UpstreamPool // nil if upstream connections are not reused
+	accounting *Accounting   // nil if accepted messages are not reported
+
+	upstreamErrors *UpstreamErrors
+
+	draining atomic.Bool // set during shutdown, new transactions are refused
+}
+
+// sessionOptions are the options that can be changed by a reload, see
+// configure. They are never modified once built. A reload builds new ones,
+// and each session keeps those it started with.
+type sessionOptions struct {
 	domain   string
 	mappings []Mapping
+	resolver *Resolver
 
+	mappingKey         string // "rcpt", "rcpt_domain", "from_full", "from_domain" or "client_cert_cn"
+	requireStarttls    bool
+	requireClientCert  bool // restart-only, the TLS config is set up once
 	recipientDelimiter string
+	requireHeaders     []string
+	logHeaders         []string
+	redactHeaders      []string
+	fromAlignment      string // "off", "log" or "enforce"
+	fromAlignExempt    []string
+	allowedSenders     []string
+	allowedRcpts       []string
+	deniedRcpts        []string
+	maxReceivedHops    int
+	maxHeaderBytes     int
+	maxHeaderCount     int
+	forwardRcptParams  []string
+	stripDsnParams     bool
+	xforward           bool
+	addReceivedHeader  bool
+	dkim               *dkim.SignOptions // nil if dkim isn't configured
+	maxRcptErrors      int
+	maxMessageBytes    int // see max_message_bytes
+	maxTransactions    int
+	maxConnectionRcpts int
+	perSessionRate     int // bytes per second, 0 if unlimited
+
+	dialRetries      int // see upstream_dial_retries
+	dialBackoff      time.Duration
+	upstreamAffinity string        // "none" or "client_ip", see upstream_affinity
+	upstreamTlsMode  TlsMode       // used if the mapping returns no tls_mode
+	fullFailover     bool          // see upstream_full_failover
+	greetingTimeout  time.Duration // see upstream_greeting_timeout
+	upstreamTimeout  time.Duration // see upstream_timeout
+
+	lostAfterData   string // "tempfail" or "accept", see upstream_lost_after_data
+	chunkingTimeout time.Duration
+	dataTimeout     time.Duration // see data_timeout
+	commandTimeout  time.Duration // go-smtp's ReadTimeout, restored after DATA
+	dedupAction     string        // "accept" or "reject", see dedup_action
+
+	dataSlots  chan struct{} // limits concurrent DATA transfers, nil if unlimited
+	globalRate *RateLimiter  // shared by all sessions, nil if unlimited
+
+	abruptDisconnectLogLevel log.Lvl
+	slowThreshold            time.Duration // 0 if slow operations are not logged
+
+	shutdownMessage string
 }
 
 func (b *ProxyBackend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
@@ -43,31 +235,135 @@ func (b *ProxyBackend) Login(_ *smtp.ConnectionState, username, password string)
 func (b *ProxyBackend) AnonymousLogin(s *smtp.ConnectionState) (smtp.Session, error) {
 	logger, ok := b.loggers.Get(s.RemoteAddr)
 	if !ok {
-		logger = log.New("sid", "") // fallback, should not happen :)
+		logger = log.New("sid", "", componentKey, "proxy") // fallback, should not happen :)
+	}
+
+	if b.draining.Load() {
+		if conn, ok := b.loggers.Conn(s.RemoteAddr); ok {
+			conn.closeAfterReply()
+		}
+		return nil, b.shutdownError()
+	}
+
+	stats, ok := b.loggers.Stats(s.RemoteAddr)
+	if !ok {
+		stats = NewSessionStats() // fallback, should not happen either
+	}
+
+	conn, _ := b.loggers.Conn(s.RemoteAddr) // nil if not found, deadlines are left to go-smtp then
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	b.sessions.Add(1)
+
+	if s.TLS.HandshakeComplete {
+		stats.setTls()
+	}
+
+	// The client's certificate is part of everything logged for the session
+	certName, hasCert := clientCertName(s.TLS)
+	if hasCert {
+		logger = logger.New("client_cert", certName)
 	}
 
 	logger.Debug("TLS", "connection_state", s)
-	logger.Debug("HELO/EHLO", "client", s.RemoteAddr, "client_helo", s.Hostname, "tls", s.TLS.HandshakeComplete)
+	logger.Debug("HELO/EHLO", "client", s.RemoteAddr, "client_helo", s.Hostname, "tls", s.TLS.HandshakeComplete,
+		"tls_alpn", s.TLS.NegotiatedProtocol, "tls_sni", s.TLS.ServerName)
 
+	opts := b.opts
 	return &LoggingSession{
-		log: logger,
+		log:           logger,
+		slowThreshold: opts.slowThreshold,
 		delegate: &ProxySession{
-			log:      logger,
-			mappings: b.mappings,
+			log:            logger,
+			sessionOptions: opts,
+
+			sessionRate: opts.newSessionRate(),
+			dedup:       b.dedup,
+			pool:        b.pool,
+			accounting:  b.accounting,
 
-			recipientDelimiter: b.recipientDelimiter,
+			backend: b,
+			stats:   stats,
+			conn:    conn,
+			done:    b.sessions.Done,
 
 			clientHelo: s.Hostname,
 			clientAddr: s.RemoteAddr,
 			clientTls:  s.TLS.HandshakeComplete,
+			clientCert: certName,
+			hasCert:    hasCert,
 
-			helo: b.domain,
+			helo: opts.domain,
 
 			msg: buildZeroProxyMessage(),
 		},
 	}, nil
 }
 
+func (o *sessionOptions) newSessionRate() *RateLimiter {
+	if o.perSessionRate <= 0 {
+		return nil
+	}
+	return NewRateLimiter(o.perSessionRate)
+}
+
+func (b *ProxyBackend) shutdownError() *smtp.SMTPError {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      b.opts.shutdownMessage,
+	}
+}
+
+// drainCheckInterval is the time between the checks for idle sessions during
+// shutdown, see closeIdleSessions.
+const drainCheckInterval = 100 * time.Millisecond
+
+// closeIdleSessions replies 421 with shutdown_message to the sessions of s
+// that wait for the client's next command outside of a transaction, and
+// closes them. It checks again every drainCheckInterval until stop is closed,
+// so sessions are closed at their next command boundary. Sessions in a
+// transaction are left to finish it. Connections without a session (before
+// EHLO) get the 421 for their EHLO from AnonymousLogin.
+func (b *ProxyBackend) closeIdleSessions(s *smtp.Server, stop <-chan struct{}) {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	reply := b.shutdownError()
+	for {
+		var conns []*smtp.Conn
+		s.ForEachConn(func(c *smtp.Conn) {
+			conns = append(conns, c)
+		})
+
+		for _, c := range conns {
+			ls, ok := c.Session().(*LoggingSession)
+			if !ok || ls.delegate.conn == nil || ls.delegate.inTransaction.Load() {
+				continue
+			}
+
+			closed := ls.delegate.conn.closeIdle(func() {
+				c.WriteResponse(reply.Code, reply.EnhancedCode, reply.Message)
+				c.Close()
+			})
+			if closed {
+				ls.log.Debug("Closed idle session for shutdown")
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
 // https://stackoverflow.com/a/22892986 - because I'm lazy
 var letters = []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
@@ -80,28 +376,62 @@ func randSeq(n int) string {
 }
 
 type ProxySession struct {
-	log      log.Logger
-	mappings []Mapping
+	log log.Logger
 
-	recipientDelimiter string
+	*sessionOptions // of the config the session started with
+
+	sessionRate *RateLimiter // nil if unlimited
+	dedup       *DedupCache
+	pool        *UpstreamPool
+	accounting  *Accounting
+
+	backend *ProxyBackend
+	stats   *SessionStats
+	conn    *SessionConn // nil if unknown
+	done    func()       // called on logout
 
 	clientHelo string
 	clientAddr net.Addr
 	clientTls  bool
+	clientCert string // common name of the client's verified certificate
+	clientHost string // hostname of the client, empty until clientIdentity looked it up
+	hasCert    bool
 
 	helo string
 
+	rcptErrors   int // number of recipients rejected permanently in this session
+	transactions int // number of messages the upstream accepted in this session
+	rcpts        int // number of recipients accepted in this session
+
 	msg ProxyMessage // the current message tx
+
+	inTransaction atomic.Bool // between an accepted MAIL and the next reset, see closeIdleSessions
 }
 
 type ProxyMessage struct {
 	from   string
 	rcpts  []string
 	server string
+	domain string // recipient domain the upstream was selected by, only set for mapping_key rcpt_domain
+
+	routingKey string // key the upstream was looked up by, see mapping_key
+
+	maxMessageBytes int   // upstream specific size limit, 0 if none
+	accepted        int   // number of recipients accepted by the upstream
+	bytes           int64 // message bytes passed to the upstream
 
 	client *smtp.Client // this is the client used to connect to the upstream smtp server!
+	conn   net.Conn     // TCP connection of client, for the deadlines of upstream_timeout
+	addr   string       // IP of the upstream server the client is connected to
 	tls    bool
 	opts   smtp.MailOptions
+
+	poolKey  string
+	reusable bool // client is set up and not in the middle of DATA
+
+	full []string // IPs of the upstream server that are out of resources, see upstream_full_failover
+
+	connectTime time.Duration // time it took to connect to the upstream during the current RCPT
 }
 
 func buildProxyMessage(from string, opts smtp.MailOptions) ProxyMessage {
@@ -117,32 +447,109 @@ func buildZeroProxyMessage() ProxyMessage {
 	return buildProxyMessage("", smtp.MailOptions{})
 }
 
-func (s *ProxySession) getUpstream(recipient string) (Upstream, error) {
-	for _, mapping := range s.mappings {
-		server, err := s.lookupRecipient(mapping, recipient)
+// routingDecision records why an upstream server was chosen, for debugging
+// and auditing the routing configuration.
+type routingDecision struct {
+	routingKey string // key the upstream was looked up by, see mapping_key
+	mapping    string // type of the mapping that matched
+	index      int    // position of the mapping in mappings, > 0 if earlier mappings had no match
+	match      string // kind of key that matched: exact, without_suffix, domain or catch_all
+	matchedKey string // key that matched, after fallbacks
+}
+
+func (d routingDecision) logCtx() []interface{} {
+	return []interface{}{"routing_key", d.routingKey, "mapping", d.mapping, "mapping_index", d.index,
+		"match", d.match, "matched_key", d.matchedKey}
+}
+
+func (s *ProxySession) getUpstream(recipient string) (Upstream, routingDecision, error) {
+	for i, mapping := range s.mappings {
+		server, match, err := s.lookupMapping(mapping, recipient)
 		if err == ErrNoUpstreamFound {
 			continue
 		}
 
-		if !strings.Contains(server.Server, ":") {
-			server.Server = server.Server + ":25"
+		// A static mapping matches whatever key it gets
+		if _, ok := mapping.(*staticMapping); ok && err == nil {
+			match = lookupMatch{"catch_all", ""}
+		}
+
+		if server.TlsMode == TlsModeDefault {
+			server.TlsMode = s.upstreamTlsMode
 		}
+		server.Server = upstreamAddress(server)
+		return server, routingDecision{
+			routingKey: s.routingKey(recipient),
+			mapping:    mappingType(mapping),
+			index:      i,
+			match:      match.kind,
+			matchedKey: match.key,
+		}, err
+	}
+
+	return Upstream{}, routingDecision{}, ErrNoUpstreamFound
+}
+
+// upstreamAddress returns the server of upstream, with the default port of its
+// TLS mode if it has none.
+func upstreamAddress(upstream Upstream) string {
+	if strings.Contains(upstream.Server, ":") {
+		return upstream.Server
+	}
+
+	if upstream.TlsMode == TlsModeSmtps {
+		return upstream.Server + ":465"
+	}
+	return upstream.Server + ":25"
+}
+
+// lookupMatch is the key a lookup matched, and which kind of key it is.
+type lookupMatch struct {
+	kind string // exact, without_suffix or domain
+	key  string
+}
+
+// lookupMapping looks up the upstream server in mapping by the configured
+// mapping key.
+func (s *ProxySession) lookupMapping(mapping Mapping, recipient string) (Upstream, lookupMatch, error) {
+	switch s.mappingKey {
+	case "rcpt_domain":
+		return s.lookupSingleKey(mapping, addressDomain(recipient))
+	case "from_full":
+		return s.lookupSingleKey(mapping, s.msg.from)
+	case "from_domain":
+		return s.lookupSingleKey(mapping, addressDomain(s.msg.from))
+	case "client_cert_cn":
+		return s.lookupSingleKey(mapping, s.clientCert)
+	default:
+		return s.lookupRecipient(mapping, recipient)
+	}
+}
+
+// lookupSingleKey looks up key without any fallbacks. An empty key (e.g. the
+// null sender of a bounce) never matches.
+func (s *ProxySession) lookupSingleKey(mapping Mapping, key string) (Upstream, lookupMatch, error) {
+	if key == "" {
+		return Upstream{}, lookupMatch{}, ErrNoUpstreamFound
+	}
 
-		return server, err
+	server, err := s.lookupKey(mapping, key)
+	if err != nil && err != ErrNoUpstreamFound {
+		return Upstream{}, lookupMatch{}, fmt.Errorf("lookup %s: %w", mappingType(mapping), err)
 	}
 
-	return Upstream{}, ErrNoUpstreamFound
+	return server, lookupMatch{"exact", key}, err
 }
 
-func (s *ProxySession) lookupRecipient(mapping Mapping, recipient string) (Upstream, error) {
+func (s *ProxySession) lookupRecipient(mapping Mapping, recipient string) (Upstream, lookupMatch, error) {
 	// foo+bar@domain.com
 	server, err := s.lookupKey(mapping, recipient)
 	if err == nil {
-		return server, nil
+		return server, lookupMatch{"exact", recipient}, nil
 	}
 
 	if err != ErrNoUpstreamFound {
-		return Upstream{}, fmt.Errorf("lookup %T: %w", mapping, err)
+		return Upstream{}, lookupMatch{}, fmt.Errorf("lookup %s: %w", mappingType(mapping), err)
 	}
 
 	if s.recipientDelimiter != "" {
@@ -152,11 +559,11 @@ func (s *ProxySession) lookupRecipient(mapping Mapping, recipient string) (Upstr
 			// foo@domain.com
 			server, err = s.lookupKey(mapping, recipientWithoutSuffix)
 			if err == nil {
-				return server, nil
+				return server, lookupMatch{"without_suffix", recipientWithoutSuffix}, nil
 			}
 
 			if err != ErrNoUpstreamFound {
-				return Upstream{}, fmt.Errorf("lookup %T: %w", mapping, err)
+				return Upstream{}, lookupMatch{}, fmt.Errorf("lookup %s: %w", mappingType(mapping), err)
 			}
 		}
 	}
@@ -168,165 +575,1212 @@ func (s *ProxySession) lookupRecipient(mapping Mapping, recipient string) (Upstr
 		// domain.com
 		server, err = s.lookupKey(mapping, domain)
 		if err == nil {
-			return server, nil
+			return server, lookupMatch{"domain", domain}, nil
+		}
+
+		if err != ErrNoUpstreamFound {
+			return Upstream{}, lookupMatch{}, fmt.Errorf("lookup %s: %w", mappingType(mapping), err)
+		}
+	}
+
+	return Upstream{}, lookupMatch{}, ErrNoUpstreamFound
+}
+
+func (s *ProxySession) lookupKey(mapping Mapping, key string) (Upstream, error) {
+	logger := s.log.New(componentKey, "mapping")
+
+	server, err := mapping.Get(key)
+	if err == nil {
+		// String() redacts auth_password
+		logger.Debug("Lookup match", "mapping", mappingType(mapping), "key", key, "result", server.String())
+	}
+	if err == ErrNoUpstreamFound {
+		logger.Debug("Lookup miss", "mapping", mappingType(mapping), "key", key)
+	}
+
+	return server, err
+}
+
+func removeSuffix(recipient string, recipientDelimiter string) string {
+	parts1 := strings.Split(recipient, recipientDelimiter)
+	if len(parts1) == 2 {
+		localPart := parts1[0]
+		suffixAtDomain := parts1[1]
+
+		parts2 := strings.Split(suffixAtDomain, "@")
+		if len(parts2) == 2 {
+			domain := parts2[1]
+
+			return fmt.Sprintf("%s@%s", localPart, domain)
+		}
+	}
+
+	return recipient
+}
+
+// clientIdentity returns the client's IP address and hostname formatted for
+// XCLIENT/XFORWARD.
+func clientIdentity(s *ProxySession) (string, string) {
+	clientIP := s.clientAddr.(*net.TCPAddr).IP
+
+	// Looked up once per session and reused for XCLIENT, XFORWARD and the
+	// Received: header of every transaction
+	if s.clientHost == "" {
+		start := time.Now()
+		hostnames, err := s.resolver.LookupAddr(clientIP.String())
+		if err != nil {
+			s.log.Debug("DNS lookup for client failed", componentKey, "dns", "client", s.clientAddr, "error", err)
+		} else {
+			s.log.Debug("Resolved client hostname", componentKey, "dns", "client", s.clientAddr,
+				"hostnames", strings.Join(hostnames, ","), "duration", time.Since(start).Round(time.Microsecond))
+		}
+		if len(hostnames) > 0 {
+			s.clientHost = strings.TrimSuffix(hostnames[0], ".")
+		} else {
+			s.clientHost = "[TEMPUNAVAIL]"
+		}
+	}
+
+	ipStr := clientIP.String()
+	if clientIP.To4() == nil {
+		ipStr = fmt.Sprintf("IPV6:%s", clientIP)
+	}
+
+	return ipStr, s.clientHost
+}
+
+func xclient(c *textproto.Conn, s *ProxySession) error {
+	ipStr, clientHost := clientIdentity(s)
+
+	// FIXME HELO/NAME must be encoded according to RFC1891 "xtext" (only relevant for non-ascii chars)
+
+	id, err := c.Cmd(fmt.Sprintf("XCLIENT ADDR=%s NAME=%s HELO=%s", ipStr, clientHost, s.clientHelo))
+	if err != nil {
+		return err
+	}
+
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+
+	if _, _, err = c.ReadCodeLine(220); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// xforward sends those of the client's attributes that the upstream server
+// supports (given as advertised in its EHLO response, e.g. "NAME ADDR PROTO HELO").
+//
+// PROTO is not sent: go-smtp doesn't tell us whether the client used HELO or EHLO.
+func xforward(c *textproto.Conn, s *ProxySession, supported string) error {
+	ipStr, clientHost := clientIdentity(s)
+
+	values := map[string]string{
+		"NAME": clientHost,
+		"ADDR": ipStr,
+		"HELO": s.clientHelo,
+	}
+
+	attrs := make([]string, 0, len(values))
+	for _, name := range strings.Fields(strings.ToUpper(supported)) {
+		if value, ok := values[name]; ok && value != "" {
+			attrs = append(attrs, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	// FIXME HELO/NAME must be encoded according to RFC1891 "xtext" (only relevant for non-ascii chars)
+
+	id, err := c.Cmd("XFORWARD %s", strings.Join(attrs, " "))
+	if err != nil {
+		return err
+	}
+
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+
+	if _, _, err = c.ReadCodeLine(250); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *ProxySession) Mail(from string, opts smtp.MailOptions) error {
+	if s.backend.draining.Load() {
+		return s.backend.shutdownError()
+	}
+
+	if s.requireStarttls && !s.clientTls {
+		s.log.Info("Client did not use STARTTLS, rejecting", "client", s.clientAddr)
+		return ErrStarttlsRequired
+	}
+
+	// The TLS handshake fails without a valid certificate, but clients may
+	// skip STARTTLS
+	if s.requireClientCert && !s.hasCert {
+		s.log.Info("Client did not authenticate with a certificate, rejecting", "client", s.clientAddr,
+			"client_tls", s.clientTls)
+		return ErrClientCertRequired
+	}
+
+	if s.maxTransactions > 0 && s.transactions >= s.maxTransactions {
+		s.log.Info("Too many transactions, disconnecting", "client", s.clientAddr, "transactions", s.transactions)
+		return ErrTooManyTransactions
+	}
+
+	// go-smtp already rejects a larger SIZE= before calling Mail. Never start a
+	// transaction that can't succeed, in case that ever changes. The size is
+	// passed on to the upstream server's MAIL FROM if it supports SIZE.
+	if s.maxMessageBytes > 0 && opts.Size > s.maxMessageBytes {
+		s.log.Info("Declared message size exceeds max_message_bytes, rejecting", "from", from, "size", opts.Size,
+			"max_message_bytes", s.maxMessageBytes)
+		return ErrMessageTooLarge
+	}
+
+	// Bounces (empty MAIL FROM) have no sender domain to check
+	if len(s.allowedSenders) > 0 && from != "" && !domainMatches(addressDomain(from), s.allowedSenders) {
+		s.log.Info("Sender domain not allowed, rejecting", "from", from, "client", s.clientAddr)
+		return ErrSenderNotAllowed
+	}
+
+	s.msg = buildProxyMessage(from, opts)
+	s.inTransaction.Store(true)
+	return nil
+}
+
+func (s *ProxySession) Rcpt(to string) error {
+	if s.maxConnectionRcpts > 0 && s.rcpts >= s.maxConnectionRcpts {
+		s.log.Info("Too many recipients in this connection", "client", s.clientAddr, "rcpts", s.rcpts)
+		return ErrTooManyConnectionRcpts
+	}
+
+	err := s.checkRecipientDomain(to)
+	if err == nil {
+		err = s.checkUpstreamReply(s.rcpt(to))
+	}
+	if err == nil {
+		s.rcpts++
+	}
+
+	if smtpErr, ok := err.(*smtp.SMTPError); ok && smtpErr.Code >= 500 {
+		s.rcptErrors++
+		if s.maxRcptErrors > 0 && s.rcptErrors > s.maxRcptErrors {
+			s.log.Info("Too many invalid recipients, disconnecting", "client", s.clientAddr, "rcpt_errors", s.rcptErrors)
+			return ErrTooManyRcptErrors
+		}
+	}
+
+	return err
+}
+
+// checkRecipientDomain rejects recipients in denied_recipient_domains, and
+// those not in allowed_recipient_domains if that is set. Only this recipient
+// is rejected, the others of the transaction are not affected.
+func (s *ProxySession) checkRecipientDomain(to string) error {
+	if len(s.allowedRcpts) == 0 && len(s.deniedRcpts) == 0 {
+		return nil
+	}
+
+	to, _ = splitRcptParams(to)
+	domain := addressDomain(to)
+	if domainMatches(domain, s.deniedRcpts) ||
+		(len(s.allowedRcpts) > 0 && !domainMatches(domain, s.allowedRcpts)) {
+		s.log.Info("Recipient domain not allowed, rejecting", "to", to, "from", s.msg.from, "client", s.clientAddr)
+		return ErrRecipientNotAllowed
+	}
+
+	return nil
+}
+
+func (s *ProxySession) rcpt(to string) error {
+	to, params := splitRcptParams(to)
+	s.msg.rcpts = append(s.msg.rcpts, to)
+
+	// The recipients accepted so far are lost with a closed upstream connection
+	if s.msg.client == nil && s.msg.accepted > 0 {
+		return ErrInternal
+	}
+
+	if s.msg.client == nil {
+		upstream, route, err := s.getUpstream(to)
+		if err == ErrNoUpstreamFound {
+			return ErrRelayAccessDenied
 		}
+		if err != nil {
+			return err
+		}
+		s.log.Debug("Routing decision", append([]interface{}{componentKey, "mapping", "to", to,
+			"upstream", upstream.Server}, route.logCtx()...)...)
+
+		if upstream.MaxMessageBytes > 0 && s.msg.opts.Size > upstream.MaxMessageBytes {
+			return ErrMessageTooLarge
+		}
+
+		s.msg.server = upstream.Server
+		s.msg.routingKey = route.routingKey
+		s.msg.maxMessageBytes = upstream.MaxMessageBytes
+		if s.mappingKey == "rcpt_domain" {
+			s.msg.domain = addressDomain(to)
+		}
+
+		start := time.Now()
+		err = s.connectFailover(upstream)
+		s.msg.connectTime = time.Since(start)
+		if err == ErrSmtpUtf8Unsupported {
+			s.log.Info("Client requested SMTPUTF8, but upstream server does not support it", "from", s.msg.from,
+				"to", to, "upstream", s.msg.server)
+			s.abortUpstream()
+			return err
+		}
+		if err != nil {
+			return s.upstreamStalled(s.connectError(s.upstreamError(err)), "connect")
+		}
+		s.stats.addUpstream(s.msg.server)
+	} else if s.mappingKey == "rcpt_domain" {
+		if err := s.checkSameUpstream(to); err != nil {
+			return err
+		}
+	}
+
+	if err := s.sendRcpt(to, s.forwardedParams(params)); err != nil {
+		if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code < 400 {
+			// Rejected recipients are business as usual, only keep I/O and protocol errors
+			s.upstreamError(err)
+		}
+		return s.upstreamStalled(err, "RCPT")
+	}
+	s.msg.accepted++
+	s.stats.addRcpt()
+
+	return nil
+}
+
+// connectError logs the reason of a failed certificate verification and
+// closes the unusable upstream connection. Other errors are returned as is.
+func (s *ProxySession) connectError(err error) error {
+	reason, ok := tlsVerifyFailure(err)
+	if !ok {
+		return err
+	}
+
+	s.log.Warn("TLS certificate verification of upstream server failed", componentKey, "upstream",
+		"upstream", s.msg.server, "reason", reason, "error", err)
+	if s.msg.client != nil {
+		s.abortUpstream()
+	}
+
+	return ErrUpstreamTlsVerify
+}
+
+// checkSameUpstream makes sure that a further recipient of the transaction is
+// handled by the upstream server the transaction is already proxied to. Only
+// recipients in other domains need another lookup.
+func (s *ProxySession) checkSameUpstream(to string) error {
+	if addressDomain(to) == s.msg.domain {
+		return nil
+	}
+
+	upstream, _, err := s.getUpstream(to)
+	if err == ErrNoUpstreamFound {
+		return ErrRelayAccessDenied
+	}
+	if err != nil {
+		return err
+	}
+
+	if upstream.Server != s.msg.server {
+		s.log.Debug("Recipient is handled by a different upstream server", "to", to,
+			"upstream", s.msg.server, "rcpt_upstream", upstream.Server)
+		return ErrDifferentUpstream
+	}
+
+	return nil
+}
+
+// splitRcptParams splits the RCPT parameters (e.g. NOTIFY=NEVER) from the
+// recipient. go-smtp passes them on as part of the recipient, as in
+// "foo@bar.com> NOTIFY=NEVER".
+func splitRcptParams(to string) (string, []string) {
+	fields := strings.Fields(to)
+	if len(fields) == 0 {
+		return to, nil
+	}
+
+	return strings.TrimSuffix(fields[0], ">"), fields[1:]
+}
+
+// forwardedParams returns those RCPT parameters that are configured to be
+// forwarded to the upstream server. With strip_dsn_params, DSN parameters are
+// dropped if the upstream server doesn't support DSN.
+func (s *ProxySession) forwardedParams(params []string) []string {
+	stripDsn := false
+	if s.stripDsnParams {
+		supported, _ := s.msg.client.Extension("DSN")
+		stripDsn = !supported
+	}
+
+	forwarded := make([]string, 0, len(params))
+	for _, param := range params {
+		keyword, _, _ := strings.Cut(param, "=")
+
+		if stripDsn && isDsnRcptParam(keyword) {
+			s.log.Debug("Dropping DSN parameter, upstream server does not support DSN", "param", param,
+				"upstream", s.msg.server)
+			continue
+		}
+
+		ok := false
+		for _, allowed := range s.forwardRcptParams {
+			if strings.EqualFold(keyword, allowed) {
+				ok = true
+				break
+			}
+		}
+
+		if ok {
+			forwarded = append(forwarded, param)
+		} else {
+			s.log.Debug("Dropping RCPT parameter", "param", param)
+		}
+	}
+
+	return forwarded
+}
+
+// isDsnRcptParam reports whether keyword is one of the RCPT parameters of the
+// DSN extension (RFC 3461).
+func isDsnRcptParam(keyword string) bool {
+	return strings.EqualFold(keyword, "NOTIFY") || strings.EqualFold(keyword, "ORCPT")
+}
+
+func (s *ProxySession) sendRcpt(to string, params []string) error {
+	if len(params) == 0 {
+		return s.msg.client.Rcpt(to)
+	}
+
+	// go-smtp's client can't send RCPT parameters
+	defer s.upstreamDeadline()()
+	c := s.msg.client.Text
+	id, err := c.Cmd("RCPT TO:<%s> %s", to, strings.Join(params, " "))
+	if err != nil {
+		return err
+	}
+
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+
+	if _, _, err = c.ReadResponse(25); err != nil {
+		return toSMTPError(err)
+	}
+
+	return nil
+}
+
+// toSMTPError converts an error response read via textproto into an
+// smtp.SMTPError, like go-smtp's client does.
+func toSMTPError(err error) error {
+	protoErr, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+
+	smtpErr := &smtp.SMTPError{
+		Code:         protoErr.Code,
+		EnhancedCode: smtp.NoEnhancedCode,
+		Message:      protoErr.Msg,
+	}
+
+	if code, msg, ok := strings.Cut(protoErr.Msg, " "); ok {
+		parts := strings.Split(code, ".")
+		if len(parts) == 3 {
+			var enhanced smtp.EnhancedCode
+			valid := true
+			for i, part := range parts {
+				n, err := strconv.Atoi(part)
+				if err != nil {
+					valid = false
+				}
+				enhanced[i] = n
+			}
+			if valid {
+				smtpErr.EnhancedCode = enhanced
+				smtpErr.Message = msg
+			}
+		}
+	}
+
+	return smtpErr
+}
+
+// connect opens the connection to the upstream server and starts the
+// transaction, up to MAIL FROM.
+func (s *ProxySession) connect(upstream Upstream) error {
+	s.msg.poolKey = s.poolKey(upstream)
+
+	if pc, ok := s.getPooled(); ok {
+		s.log.Debug("Reusing pooled upstream connection", componentKey, "upstream", "upstream", s.msg.server)
+		s.msg.client = pc.client
+		s.msg.conn = pc.conn
+		s.msg.addr = pc.addr
+		s.msg.tls = pc.tls
+		s.msg.reusable = true
+		if s.upstreamTimeout > 0 {
+			s.msg.client.CommandTimeout = s.upstreamTimeout
+		}
+	} else if err := s.dialRetrying(upstream); err != nil {
+		return err
+	}
+
+	// go-smtp's client only sets deadlines for its own commands
+	defer s.upstreamDeadline()()
+
+	if ok, _ := s.msg.client.Extension("XCLIENT"); ok {
+		if err := xclient(s.msg.client.Text, s); err != nil {
+			return err
+		}
+	}
+
+	if ok, params := s.msg.client.Extension("XFORWARD"); ok && s.xforward {
+		if err := xforward(s.msg.client.Text, s, params); err != nil {
+			return err
+		}
+	}
+
+	// go-smtp's client would fail with an error that isn't an SMTP reply
+	if supported, _ := s.msg.client.Extension("SMTPUTF8"); s.msg.opts.UTF8 && !supported {
+		return ErrSmtpUtf8Unsupported
+	}
+
+	if err := s.msg.client.Mail(s.msg.from, &s.msg.opts); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// connectFailover calls connect. If upstream_full_failover is enabled and the
+// upstream server is out of resources, the next address of the upstream server
+// is tried. Once no address is left, the client gets the reply of the last
+// one.
+func (s *ProxySession) connectFailover(upstream Upstream) error {
+	s.msg.full = nil
+
+	err := s.connect(upstream)
+	for s.fullFailover && isUpstreamFull(err) {
+		s.log.Info("Upstream server is out of resources, trying next address", componentKey, "upstream",
+			"upstream", s.msg.server, "addr", s.msg.addr, "error", err)
+		s.msg.full = append(s.msg.full, s.msg.addr)
+		s.abortUpstream()
+
+		next := s.connect(upstream)
+		if errors.Is(next, errNoAddressLeft) {
+			return err
+		}
+		err = next
+	}
+
+	return err
+}
+
+// isUpstreamFull tells whether err is the reply of an upstream server that is
+// out of resources to MAIL FROM: 452 (insufficient system storage), with
+// enhanced status code 4.3.1 or none.
+func isUpstreamFull(err error) bool {
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code != 452 {
+		return false
+	}
+
+	return smtpErr.EnhancedCode == smtp.EnhancedCode{4, 3, 1} || smtpErr.EnhancedCode == smtp.EnhancedCode{}
+}
+
+// dialRetrying calls dial, and retries temporary failures up to
+// upstream_dial_retries times with exponential backoff and jitter. The RCPT of
+// the client waits meanwhile. Once the retries are exhausted, the last error
+// is wrapped, so the client gets a 450 and tries again later.
+func (s *ProxySession) dialRetrying(upstream Upstream) error {
+	backoff := s.dialBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.dial(upstream)
+		if err == nil {
+			return nil
+		}
+
+		if s.msg.client != nil {
+			s.msg.client.Close()
+			s.msg.client = nil
+		}
+		s.msg.tls = false
+
+		if !retryableDialError(err) || s.dialRetries == 0 {
+			return err
+		}
+		if attempt > s.dialRetries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		s.upstreamError(err)
+
+		// Sleep between half and all of the backoff, so sessions that failed
+		// at the same time don't retry at the same time
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		s.log.Info("Connecting to upstream server failed, retrying", componentKey, "upstream",
+			"upstream", s.msg.server, "attempt", attempt, "retries", s.dialRetries, "wait", wait.Round(time.Millisecond),
+			"error", err)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// retryableDialError tells whether setting up the upstream connection might
+// succeed on another attempt: network errors and temporary (4xx) replies, e.g.
+// 421 to the greeting or 454 to AUTH. TLS verification failures and 5xx
+// replies, e.g. 535 for rejected credentials, are final.
+func retryableDialError(err error) bool {
+	if _, ok := tlsVerifyFailure(err); ok {
+		return false
+	}
+
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// dial opens a new connection to the upstream server, up to and including
+// STARTTLS and AUTH.
+func (s *ProxySession) dial(upstream Upstream) error {
+	conn, err := s.resolver.Dial(s.msg.server, s.affinity(), s.msg.full, s.log)
+	if err != nil {
+		return err
+	}
+	s.msg.addr = conn.RemoteAddr().(*net.TCPAddr).IP.String()
+
+	host, _, _ := net.SplitHostPort(s.msg.server)
+	cfg := upstreamTlsConfig(host, upstream)
+
+	c, err := greetUpstream(conn, host, upstream.TlsMode, cfg, s.greetingTimeout)
+	if err != nil {
+		return err
+	}
+	s.msg.client = c
+	s.msg.conn = conn
+	s.msg.tls = upstream.TlsMode == TlsModeSmtps
+	if s.upstreamTimeout > 0 {
+		c.CommandTimeout = s.upstreamTimeout
+	}
+
+	if err := s.msg.client.Hello(s.helo); err != nil {
+		return err
+	}
+
+	if ok, _ := s.msg.client.Extension("STARTTLS"); s.useStarttls(upstream.TlsMode, ok) {
+		s.log.Debug("Trying STARTTLS with upstream server", componentKey, "upstream")
+
+		if !ok {
+			return fmt.Errorf("upstream server does not support STARTTLS (tls_mode %s)", upstream.TlsMode)
+		}
+		if err := s.msg.client.StartTLS(cfg); err != nil {
+			return err
+		}
+		s.msg.tls = true
+	}
+
+	if err := authUpstream(s.msg.client, upstream, s.msg.tls); err != nil {
+		return err
+	}
+
+	s.msg.reusable = true
+
+	return nil
+}
+
+// greetUpstream sets up the SMTP client on a new connection to an upstream
+// server, with implicit TLS in smtps mode, and reads its greeting. The TLS
+// handshake and the greeting must be done within timeout (0 means no limit),
+// so servers that accept connections but never greet don't hold up the
+// client.
+func greetUpstream(conn net.Conn, host string, mode TlsMode, cfg *tls.Config, timeout time.Duration) (*smtp.Client, error) {
+	raw := conn
+	if timeout > 0 {
+		raw.SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	if mode == TlsModeSmtps {
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, greetingError(err, timeout)
+		}
+		conn = tlsConn
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return nil, greetingError(err, timeout)
+	}
+
+	raw.SetReadDeadline(time.Time{})
+	return c, nil
+}
+
+// authUpstream authenticates with the auth_user and auth_password of upstream
+// (AUTH PLAIN), if it has any. The credentials are only sent over an encrypted
+// connection. A rejected AUTH is wrapped, so the client gets a 450 instead of
+// the upstream server's reply, which is about willi's credentials.
+func authUpstream(c *smtp.Client, upstream Upstream, encrypted bool) error {
+	if upstream.AuthUser == "" {
+		return nil
+	}
+
+	if !encrypted {
+		return fmt.Errorf("not sending auth_user to upstream server over an unencrypted connection (tls_mode %s)",
+			upstream.TlsMode)
+	}
+
+	ok, mechanisms := c.Extension("AUTH")
+	plain := false
+	for _, mechanism := range strings.Fields(mechanisms) {
+		plain = plain || strings.EqualFold(mechanism, sasl.Plain)
+	}
+	if !ok || !plain {
+		return fmt.Errorf("upstream server does not support AUTH PLAIN")
+	}
+
+	if err := c.Auth(sasl.NewPlainClient("", upstream.AuthUser, upstream.AuthPassword)); err != nil {
+		return fmt.Errorf("authentication with upstream server as '%s' failed: %w", upstream.AuthUser, err)
+	}
+	return nil
+}
+
+// greetingError adds context to errors caused by upstream_greeting_timeout.
+func greetingError(err error, timeout time.Duration) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("no greeting from upstream server within %s: %w", timeout, err)
+	}
+	return err
+}
+
+// affinity returns the key the upstream addresses are ordered by, see
+// upstream_affinity.
+func (s *ProxySession) affinity() string {
+	if s.upstreamAffinity == "client_ip" {
+		return s.clientAddr.(*net.TCPAddr).IP.String()
+	}
+	return ""
+}
+
+// poolKey identifies the upstream connections that can be reused for
+// upstream. In auto TLS mode, whether STARTTLS is used depends on the client.
+// Connections authenticated as one auth_user are not reused for another. With
+// upstream_affinity, connections are only reused for the same client IP, so
+// they go to the address the affinity chose.
+func (s *ProxySession) poolKey(upstream Upstream) string {
+	mode := upstream.TlsMode
+	if mode == TlsModeDefault {
+		mode = TlsModeAuto
+	}
+
+	return fmt.Sprintf("%s,%s,verify=%t,pin=%s,client_tls=%t,auth=%s,affinity=%s", upstream.Server, mode,
+		upstream.TlsVerify, upstream.TlsPin, mode == TlsModeAuto && s.clientTls, upstream.AuthUser, s.affinity())
+}
+
+// getPooled takes an idle connection for s.msg.poolKey from the pool. The
+// caller must use or close it. During failover (upstream_full_failover),
+// none is taken: it may go to an address that is out of resources.
+func (s *ProxySession) getPooled() (*pooledConn, bool) {
+	if s.pool == nil || len(s.msg.full) > 0 {
+		return nil, false
+	}
+	return s.pool.Get(s.msg.poolKey)
+}
+
+// useStarttls decides whether STARTTLS is issued with the upstream server,
+// given its TLS mode and whether it advertised STARTTLS.
+func (s *ProxySession) useStarttls(mode TlsMode, supported bool) bool {
+	switch mode {
+	case TlsModeStarttls:
+		return true
+	case TlsModeNone, TlsModeSmtps:
+		return false
+	default:
+		return supported && s.clientTls
+	}
+}
+
+// upstreamError records err in the error history of the current upstream
+// server and returns it.
+func (s *ProxySession) upstreamError(err error) error {
+	s.backend.upstreamErrors.Add(s.msg.server, err)
+	return err
+}
+
+func (s *ProxySession) Data(r io.Reader) error {
+
+	// For BDAT, go-smtp passes a pipe that is fed by the chunks of the
+	// following BDAT commands, and Data runs until the client sends LAST. Don't
+	// keep the upstream transaction open forever for a client that never does.
+	var timedOut atomic.Bool
+	if pipe, ok := r.(*io.PipeReader); ok && s.chunkingTimeout > 0 {
+		timer := time.AfterFunc(s.chunkingTimeout, func() {
+			timedOut.Store(true)
+			pipe.CloseWithError(ErrChunkingTimeout)
+		})
+		defer timer.Stop()
+	}
+
+	// go-smtp already refuses DATA without accepted recipients. Never start an
+	// empty transaction with the upstream, in case that ever changes.
+	if s.msg.accepted == 0 {
+		return ErrNoValidRecipients
+	}
+
+	if s.msg.client == nil {
+		return fmt.Errorf("SMTP client is unexpectedly nil")
+	}
+
+	// go-smtp's read deadline for the DATA command also applies to the message
+	// content. Give the content data_timeout instead, and restore the command
+	// deadline afterwards, for the rest of the content go-smtp discards after
+	// an early reply. BDAT chunks are read like commands, from another
+	// goroutine, and keep go-smtp's deadlines.
+	if _, bdat := r.(*io.PipeReader); !bdat && s.conn != nil && s.dataTimeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.dataTimeout))
+		defer func() {
+			deadline := time.Time{}
+			if s.commandTimeout > 0 {
+				deadline = time.Now().Add(s.commandTimeout)
+			}
+			s.conn.SetReadDeadline(deadline)
+		}()
+	}
+
+	if s.dataSlots != nil {
+		select {
+		case s.dataSlots <- struct{}{}:
+			defer func() { <-s.dataSlots }()
+		default:
+			return ErrTooManyTransfers
+		}
+	}
+
+	if s.inspectHeader() {
+		header, msg, err := readHeader(r, s.maxHeaderBytes, s.maxHeaderCount)
+		if header == nil {
+			return err
+		}
+		if err != nil {
+			s.log.Debug("Failed to parse message header", "error", err)
+		}
+
+		if len(s.logHeaders) > 0 {
+			s.log.Info("Message header", s.getHeaderLogCtx(header)...)
+		}
+
+		if err := s.checkHeader(header); err != nil {
+			return err
+		}
+
+		r = msg
+	}
+
+	r = newRateLimitedReader(r, s.sessionRate, s.globalRate)
+
+	var fingerprint *fingerprintWriter
+	if s.dedup != nil {
+		fingerprint = newFingerprintWriter(s.msg.from, s.msg.rcpts)
+		r = io.TeeReader(r, fingerprint)
+	}
+
+	// Added after the fingerprint, which must not depend on the time
+	if s.addReceivedHeader {
+		ip, hostname := clientIdentity(s)
+		received := receivedHeader(s.clientHelo, hostname, ip, s.helo, s.clientTls, s.msg.rcpts, time.Now())
+		r = io.MultiReader(strings.NewReader(received), r)
+	}
+
+	// The signature goes in front of the message, so the message is read into
+	// memory first, before DATA is sent upstream. It is limited by
+	// max_message_bytes; the signature itself doesn't count.
+	signature := ""
+	if s.dkim != nil && strings.EqualFold(addressDomain(s.msg.from), s.dkim.Domain) {
+		content := r
+		if s.msg.maxMessageBytes > 0 {
+			content = io.LimitReader(r, int64(s.msg.maxMessageBytes)+1)
+		}
+		msg := &bytes.Buffer{}
+		n, err := io.Copy(msg, content)
+		s.msg.bytes = n
+		if err != nil {
+			return s.transferError(err, timedOut.Load())
+		}
+		if s.msg.maxMessageBytes > 0 && n > int64(s.msg.maxMessageBytes) {
+			return ErrMessageTooLarge
+		}
+
+		if signature, err = dkimSign(msg.Bytes(), s.dkim); err != nil {
+			s.log.Info("DKIM signing failed", "from", s.msg.from, "error", err)
+			return err
+		}
+		r = msg
+	}
+
+	data, err := s.msg.client.Data()
+	if err != nil {
+		return s.upstreamStalled(s.checkUpstreamReply(s.upstreamError(err)), "DATA")
+	}
+	s.msg.reusable = false
+	w := s.deadlineWriter(data)
+
+	if _, err := io.WriteString(w, signature); err != nil {
+		return s.transferError(err, false)
+	}
+
+	if s.msg.maxMessageBytes > 0 {
+		n, err := io.Copy(w, io.LimitReader(r, int64(s.msg.maxMessageBytes)+1))
+		s.msg.bytes = n
+		if err != nil {
+			return s.transferError(err, timedOut.Load())
+		}
+		if n > int64(s.msg.maxMessageBytes) {
+			// Don't let the upstream server accept a truncated message
+			s.abortUpstream()
+			return ErrMessageTooLarge
+		}
+	} else {
+		n, err := io.Copy(w, r)
+		s.msg.bytes = n
+		if err != nil {
+			return s.transferError(err, timedOut.Load())
+		}
+	}
+
+	if fingerprint != nil && s.dedup.Contains(fingerprint.Sum()) {
+		// Closing the connection before the final dot makes the upstream
+		// server discard the message
+		s.abortUpstream()
+		return s.duplicateMessage()
+	}
+
+	if err := w.Close(); err != nil {
+		if _, ok := err.(*smtp.SMTPError); !ok {
+			return s.upstreamLostAfterData(err)
+		}
+		s.msg.reusable = true
+		return s.checkUpstreamReply(s.upstreamError(err))
+	}
+	s.msg.reusable = true
+
+	// Message is now queued by upstream server
+	s.transactions++
+
+	if fingerprint != nil {
+		s.dedup.Add(fingerprint.Sum())
+	}
+
+	if s.accounting != nil {
+		s.accounting.Report(AccountingRecord{
+			Time:       time.Now(),
+			Client:     s.clientAddr.(*net.TCPAddr).IP.String(),
+			From:       s.msg.from,
+			Rcpts:      s.msg.accepted,
+			Bytes:      s.msg.bytes,
+			Upstream:   s.msg.server,
+			RoutingKey: s.msg.routingKey,
+			ClientCert: s.clientCert,
+		})
+	}
+
+	return nil
+}
+
+// routingKey returns the key the upstream is looked up by for recipient,
+// before any fallbacks like removing the recipient's suffix.
+func (s *ProxySession) routingKey(recipient string) string {
+	switch s.mappingKey {
+	case "rcpt_domain":
+		return addressDomain(recipient)
+	case "from_full":
+		return s.msg.from
+	case "from_domain":
+		return addressDomain(s.msg.from)
+	case "client_cert_cn":
+		return s.clientCert
+	default:
+		return recipient
+	}
+}
 
-		if err != ErrNoUpstreamFound {
-			return Upstream{}, fmt.Errorf("lookup %T: %w", mapping, err)
-		}
+// transferError handles a message transfer that failed before the end of the
+// content: the client disconnected, exceeded data_timeout or chunking_timeout,
+// reset a BDAT transaction, or writing to the upstream server failed. The
+// upstream connection is closed before the final dot, so the upstream server
+// discards the partial message instead of queueing it truncated.
+func (s *ProxySession) transferError(err error, timedOut bool) error {
+	s.abortUpstream()
+
+	if timedOut {
+		s.log.Info("BDAT transfer timed out, aborting upstream transaction", "upstream", s.msg.server,
+			"timeout", s.chunkingTimeout)
+		return ErrChunkingTimeout
 	}
 
-	return Upstream{}, ErrNoUpstreamFound
-}
+	if errors.Is(err, smtp.ErrDataReset) {
+		s.log.Debug("BDAT transfer aborted by client, aborting upstream transaction", "upstream", s.msg.server)
+		return err
+	}
 
-func (s *ProxySession) lookupKey(mapping Mapping, key string) (Upstream, error) {
-	server, err := mapping.Get(key)
-	if err == nil {
-		s.log.Debug("Lookup match", "mapping", fmt.Sprintf("%T", mapping), "key", key, "result", server)
+	var writeErr *upstreamWriteError
+	if errors.As(err, &writeErr) && isTimeout(writeErr.err) {
+		return s.upstreamStalled(writeErr.err, "DATA")
 	}
-	if err == ErrNoUpstreamFound {
-		s.log.Debug("Lookup miss", "mapping", fmt.Sprintf("%T", mapping), "key", key)
+
+	s.log.Info("Message transfer failed, aborting upstream transaction", "upstream", s.msg.server,
+		"bytes", s.msg.bytes, "error", err)
+	return err
+}
+
+// upstreamDeadline limits the upstream commands that willi sends itself, which
+// go-smtp's CommandTimeout doesn't cover, to upstream_timeout. The returned
+// function clears the deadline again.
+func (s *ProxySession) upstreamDeadline() func() {
+	if s.upstreamTimeout <= 0 || s.msg.conn == nil {
+		return func() {}
 	}
 
-	return server, err
+	conn := s.msg.conn
+	conn.SetDeadline(time.Now().Add(s.upstreamTimeout))
+	return func() { conn.SetDeadline(time.Time{}) }
 }
 
-func removeSuffix(recipient string, recipientDelimiter string) string {
-	parts1 := strings.Split(recipient, recipientDelimiter)
-	if len(parts1) == 2 {
-		localPart := parts1[0]
-		suffixAtDomain := parts1[1]
+// upstreamWriter passes the message content on to the upstream server, each
+// write must be done within timeout. Write errors are returned as
+// upstreamWriteError, so they can be told apart from errors reading from the
+// client.
+type upstreamWriter struct {
+	io.WriteCloser
+	conn    net.Conn
+	timeout time.Duration
+}
 
-		parts2 := strings.Split(suffixAtDomain, "@")
-		if len(parts2) == 2 {
-			domain := parts2[1]
+func (w *upstreamWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	defer w.conn.SetWriteDeadline(time.Time{})
 
-			return fmt.Sprintf("%s@%s", localPart, domain)
-		}
+	n, err := w.WriteCloser.Write(p)
+	if err != nil {
+		return n, &upstreamWriteError{err}
 	}
+	return n, nil
+}
 
-	return recipient
+type upstreamWriteError struct {
+	err error
 }
 
-func xclient(c *textproto.Conn, s *ProxySession) error {
-	clientIP := s.clientAddr.(*net.TCPAddr).IP
+func (e *upstreamWriteError) Error() string { return e.err.Error() }
+func (e *upstreamWriteError) Unwrap() error { return e.err }
 
-	var clientHost string
-	hostnames, err := net.LookupAddr(clientIP.String())
-	if err != nil {
-		s.log.Debug("DNS lookup for client failed", "client", s.clientAddr, "error", err)
+// deadlineWriter returns w limited to upstream_timeout per write. Close isn't
+// limited, go-smtp waits up to 12 minutes for the reply to the final dot.
+func (s *ProxySession) deadlineWriter(w io.WriteCloser) io.WriteCloser {
+	if s.upstreamTimeout <= 0 || s.msg.conn == nil {
+		return w
 	}
-	if len(hostnames) > 0 {
-		clientHost = strings.TrimSuffix(hostnames[0], ".")
-	} else {
-		clientHost = "[TEMPUNAVAIL]"
+	return &upstreamWriter{WriteCloser: w, conn: s.msg.conn, timeout: s.upstreamTimeout}
+}
+
+// upstreamStalled handles an upstream server that didn't respond to command
+// within upstream_timeout. The connection is closed, and the client gets a
+// temporary error, so it tries again later. Other errors are returned as is.
+func (s *ProxySession) upstreamStalled(err error, command string) error {
+	if !isTimeout(err) {
+		return err
 	}
 
-	ipStr := clientIP.String()
-	if clientIP.To4() == nil {
-		ipStr = fmt.Sprintf("IPV6:%s", clientIP)
+	s.log.Warn("Upstream server timed out, closing connection", componentKey, "upstream",
+		"upstream", s.msg.server, "command", command, "timeout", s.upstreamTimeout, "error", err)
+	if s.msg.client != nil {
+		s.abortUpstream()
 	}
 
-	// FIXME HELO/NAME must be encoded according to RFC1891 "xtext" (only relevant for non-ascii chars)
+	return ErrInternal
+}
 
-	id, err := c.Cmd(fmt.Sprintf("XCLIENT ADDR=%s NAME=%s HELO=%s", ipStr, clientHost, s.clientHelo))
-	if err != nil {
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// checkUpstreamReply catches replies of the upstream server that go-smtp's
+// client reports as error although they aren't (1xx-3xx, e.g. 354 to RCPT or
+// 250 to DATA). The upstream is out of sync with us then, and its reply must
+// not be passed on to the client: a 250 after DATA would make the client
+// believe the message was accepted. The upstream connection is closed.
+func (s *ProxySession) checkUpstreamReply(err error) error {
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code >= 400 {
 		return err
 	}
 
-	c.StartResponse(id)
-	defer c.EndResponse(id)
+	s.log.Warn("Unexpected reply from upstream server, closing connection", "upstream", s.msg.server,
+		"reply", fmt.Sprintf("%d %s", smtpErr.Code, smtpErr.Message))
+	if s.msg.client != nil {
+		s.abortUpstream()
+	}
 
-	if _, _, err = c.ReadCodeLine(220); err != nil {
-		return err
+	return ErrUpstreamProtocol
+}
+
+// upstreamLostAfterData handles a connection to the upstream server that
+// failed after the end of DATA without a final response. The upstream may or
+// may not have queued the message. Unless configured otherwise, the client is
+// told to try again later: a duplicate is better than a lost message.
+func (s *ProxySession) upstreamLostAfterData(err error) error {
+	s.upstreamError(err)
+	s.abortUpstream()
+
+	s.log.Warn("Upstream connection lost after end of DATA, message may or may not have been queued",
+		"upstream", s.msg.server, "error", err, "action", s.lostAfterData)
+
+	if s.lostAfterData == "accept" {
+		return nil
 	}
+	return ErrUpstreamLostAfterData
+}
+
+// duplicateMessage handles a message that was already accepted within the
+// dedup window. By default the client is told that the message was accepted,
+// it most likely just didn't get the reply to its first attempt.
+func (s *ProxySession) duplicateMessage() error {
+	s.log.Info("Duplicate message, not passing it on", "from", s.msg.from, "upstream", s.msg.server,
+		"action", s.dedupAction)
 
+	if s.dedupAction == "reject" {
+		return ErrDuplicateMessage
+	}
 	return nil
 }
 
-func (s *ProxySession) Mail(from string, opts smtp.MailOptions) error {
-	s.msg = buildProxyMessage(from, opts)
-	return nil
+// abortUpstream closes the connection to the upstream server without
+// finishing the current transaction.
+func (s *ProxySession) abortUpstream() {
+	if err := s.msg.client.Close(); err != nil {
+		s.log.Warn("Error while closing connection with upstream server", "error", err)
+	}
+	s.msg.client = nil
 }
 
-func (s *ProxySession) Rcpt(to string) error {
-	s.msg.rcpts = append(s.msg.rcpts, to)
+func (s *ProxySession) inspectHeader() bool {
+	return len(s.requireHeaders) > 0 || len(s.logHeaders) > 0 || s.checksFromAlignment() || s.maxReceivedHops > 0
+}
 
-	if s.msg.client == nil {
-		upstream, err := s.getUpstream(to)
-		if err == ErrNoUpstreamFound {
-			return ErrRelayAccessDenied
-		}
-		if err != nil {
-			return err
-		}
+func (s *ProxySession) checksFromAlignment() bool {
+	return s.fromAlignment == "log" || s.fromAlignment == "enforce"
+}
 
-		s.msg.server = upstream.Server
+func (s *ProxySession) getHeaderLogCtx(header textproto.MIMEHeader) []interface{} {
+	ctx := make([]interface{}, 0, 2*len(s.logHeaders))
 
-		c, err := smtp.Dial(s.msg.server)
-		if err != nil {
-			return err
+	for _, name := range s.logHeaders {
+		values, ok := header[textproto.CanonicalMIMEHeaderKey(name)]
+		if !ok {
+			continue
 		}
-		s.msg.client = c
 
-		if err := s.msg.client.Hello(s.helo); err != nil {
-			return err
+		value := strings.Join(values, "; ")
+		for _, redacted := range s.redactHeaders {
+			if strings.EqualFold(name, redacted) {
+				value = "<redacted>"
+			}
 		}
 
-		if ok, _ := s.msg.client.Extension("STARTTLS"); ok && s.clientTls {
-			s.log.Debug("Trying STARTTLS with upstream server")
+		key := "header_" + strings.ReplaceAll(strings.ToLower(name), "-", "_")
+		ctx = append(ctx, key, value)
+	}
 
-			cfg := &tls.Config{
-				InsecureSkipVerify: !upstream.TlsVerify,
-			}
-			if err := s.msg.client.StartTLS(cfg); err != nil {
-				return err
-			}
-			s.msg.tls = true
-		}
+	return ctx
+}
 
-		if ok, _ := s.msg.client.Extension("XCLIENT"); ok {
-			if err := xclient(s.msg.client.Text, s); err != nil {
-				return err
-			}
-		}
+func (s *ProxySession) checkHeader(header textproto.MIMEHeader) error {
+	if hops := len(header["Received"]); s.maxReceivedHops > 0 && hops > s.maxReceivedHops {
+		s.log.Info("Too many Received headers, rejecting message", "from", s.msg.from, "hops", hops)
+		return ErrTooManyHops
+	}
 
-		if err := s.msg.client.Mail(s.msg.from, &s.msg.opts); err != nil {
-			return err
+	for _, name := range s.requireHeaders {
+		if _, ok := header[textproto.CanonicalMIMEHeaderKey(name)]; !ok {
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+				Message:      fmt.Sprintf("Message is missing required header %s", name),
+			}
 		}
 	}
 
-	return s.msg.client.Rcpt(to)
+	return s.checkFromAlignment(header)
 }
 
-func (s *ProxySession) Data(r io.Reader) error {
-	if s.msg.client == nil {
-		return fmt.Errorf("SMTP client is unexpectedly nil")
+// checkFromAlignment compares the domain of the envelope sender with the
+// domains in the From: header. Bounces (null sender), mailing list messages
+// (List-Id: header) and exempted sender domains are not checked.
+func (s *ProxySession) checkFromAlignment(header textproto.MIMEHeader) error {
+	if !s.checksFromAlignment() || s.msg.from == "" || header.Get("List-Id") != "" {
+		return nil
 	}
 
-	w, err := s.msg.client.Data()
-	if err != nil {
-		return err
+	envelopeDomain := addressDomain(s.msg.from)
+	for _, exempt := range s.fromAlignExempt {
+		if domainsAligned(envelopeDomain, strings.ToLower(exempt)) {
+			return nil
+		}
 	}
 
-	if _, err := io.Copy(w, r); err != nil {
-		return err
+	domains, err := fromDomains(header)
+	if err == nil {
+		for _, domain := range domains {
+			if !domainsAligned(envelopeDomain, domain) {
+				err = fmt.Errorf("From header domain %s does not match envelope sender domain %s", domain, envelopeDomain)
+				break
+			}
+		}
 	}
-
-	if err := w.Close(); err != nil {
-		return err
+	if err == nil {
+		return nil
 	}
 
-	// Message is now queued by upstream server
+	s.log.Info("From header not aligned with envelope sender", "from", s.msg.from,
+		"header_from", header.Get("From"), "reason", err, "enforce", s.fromAlignment == "enforce")
+	if s.fromAlignment == "enforce" {
+		return ErrFromNotAligned
+	}
 
 	return nil
 }
 
 func (s *ProxySession) Reset() { // called after each message DATA
+	s.inTransaction.Store(false)
+
 	if s.msg.client == nil {
 		return
 	}
 
+	if s.pool != nil && s.msg.reusable {
+		pc := &pooledConn{client: s.msg.client, conn: s.msg.conn, addr: s.msg.addr, tls: s.msg.tls}
+		if s.pool.Put(s.msg.poolKey, pc) {
+			s.msg = buildZeroProxyMessage()
+			return
+		}
+	}
+
 	if err := s.msg.client.Quit(); err != nil {
 		log.Warn("Error during QUIT with upstream server. Closing connection anyway", "error", err)
 
@@ -339,21 +1793,56 @@ func (s *ProxySession) Reset() { // called after each message DATA
 }
 
 func (s *ProxySession) Logout() error {
+	defer s.done()
+
 	if s.msg.client == nil {
 		return nil
 	}
 
-	defer s.msg.client.Close()
-	return s.msg.client.Quit()
+	// Reset() is called after each DATA and on RSET, so an upstream connection
+	// that is still open here belongs to a transaction the client abandoned by
+	// disconnecting. Don't wait for the upstream to answer a QUIT, just close
+	// the connection so the upstream aborts the transaction.
+	logAt(s.log, s.abruptDisconnectLogLevel, "Client disconnected during transaction",
+		"client", s.clientAddr, "upstream", s.msg.server)
+	s.stats.abort()
+
+	err := s.msg.client.Close()
+	s.msg = buildZeroProxyMessage()
+
+	return err
+}
+
+func logAt(logger log.Logger, lvl log.Lvl, msg string, ctx ...interface{}) {
+	switch lvl {
+	case log.LvlCrit:
+		logger.Crit(msg, ctx...)
+	case log.LvlError:
+		logger.Error(msg, ctx...)
+	case log.LvlWarn:
+		logger.Warn(msg, ctx...)
+	case log.LvlInfo:
+		logger.Info(msg, ctx...)
+	default:
+		logger.Debug(msg, ctx...)
+	}
 }
 
 type LoggingSession struct {
-	log      log.Logger
-	delegate *ProxySession
+	log           log.Logger
+	slowThreshold time.Duration
+	delegate      *ProxySession
+
+	// data is held while Data runs. For BDAT, go-smtp runs Data in its own
+	// goroutine until LAST, and calls Reset or Logout right after aborting a
+	// transfer, while Data may still be running.
+	data sync.Mutex
 }
 
 func (s *LoggingSession) Mail(from string, opts smtp.MailOptions) error {
+	start := time.Now()
 	err := s.delegate.Mail(from, opts)
+	s.logSlow("mail", time.Since(start))
 	s.logDebug(err, "MAIL FROM", "from", from, "opts", opts)
 
 	if err != nil {
@@ -364,7 +1853,14 @@ func (s *LoggingSession) Mail(from string, opts smtp.MailOptions) error {
 }
 
 func (s *LoggingSession) Rcpt(to string) error {
+	// The upstream connection is set up during the first RCPT, time it separately
+	s.delegate.msg.connectTime = 0
+
+	start := time.Now()
 	err := s.delegate.Rcpt(to)
+	s.logSlow("connect", s.delegate.msg.connectTime)
+	s.logSlow("rcpt", time.Since(start)-s.delegate.msg.connectTime)
+
 	s.logDebug(err, "RCPT TO", "to", to)
 
 	if err != nil {
@@ -375,8 +1871,14 @@ func (s *LoggingSession) Rcpt(to string) error {
 }
 
 func (s *LoggingSession) Data(r io.Reader) error {
+	s.data.Lock()
+	defer s.data.Unlock()
+
+	start := time.Now()
 	err := s.delegate.Data(r)
+	s.logSlow("data", time.Since(start))
 	s.logDebug(err, "DATA")
+	s.delegate.stats.addMessage(s.delegate.msg.bytes, err)
 
 	text := "Message accepted"
 	if err != nil {
@@ -389,7 +1891,10 @@ func (s *LoggingSession) Data(r io.Reader) error {
 }
 
 func (s *LoggingSession) Reset() {
-	// Called after each DATA, but also if client sends RSET
+	// Called after each DATA, but also if client sends RSET. After an
+	// aborted BDAT transfer, wait for Data to return.
+	s.data.Lock()
+	defer s.data.Unlock()
 
 	s.delegate.Reset()
 	s.log.Debug("Reset")
@@ -397,6 +1902,8 @@ func (s *LoggingSession) Reset() {
 
 func (s *LoggingSession) Logout() error {
 	// Called when client disconnects (QUIT), or closes the connection
+	s.data.Lock()
+	defer s.data.Unlock()
 
 	err := s.delegate.Logout()
 	s.logDebug(err, "Logout")
@@ -428,11 +1935,24 @@ func (s *LoggingSession) logDebug(err error, msg string, ctx ...interface{}) {
 	s.log.Debug(msg, ctx...)
 }
 
+// logSlow warns about an operation that took longer than slow_log_threshold.
+func (s *LoggingSession) logSlow(phase string, d time.Duration) {
+	if s.slowThreshold <= 0 || d < s.slowThreshold {
+		return
+	}
+
+	s.log.Warn("Slow operation", componentKey, "slow", "phase", phase, "duration", d.Round(time.Millisecond),
+		"client", s.delegate.clientAddr, "upstream", s.delegate.msg.server)
+}
+
 func (s *LoggingSession) wrapAsSMTPError(err error) error {
 	switch err.(type) {
 	case nil:
 		return nil
 	case *smtp.SMTPError:
+		if err.(*smtp.SMTPError).Code == 421 && s.delegate.conn != nil {
+			s.delegate.conn.closeAfterReply()
+		}
 		return err
 	default:
 		return ErrInternal
@@ -467,15 +1987,26 @@ func (s *LoggingSession) formatErrorSource(err error) string {
 
 type SessionLoggers struct {
 	loggers map[net.Addr]log.Logger
+	stats   map[net.Addr]*SessionStats
+	conns   map[net.Addr]*SessionConn
 	lock    sync.RWMutex
 }
 
+func NewSessionLoggers() *SessionLoggers {
+	return &SessionLoggers{
+		loggers: make(map[net.Addr]log.Logger),
+		stats:   make(map[net.Addr]*SessionStats),
+		conns:   make(map[net.Addr]*SessionConn),
+	}
+}
+
 func (s *SessionLoggers) New(addr net.Addr) log.Logger {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	l := log.New("sid", randSeq(10))
+	l := log.New("sid", randSeq(10), componentKey, "proxy")
 	s.loggers[addr] = l
+	s.stats[addr] = NewSessionStats()
 	return l
 }
 
@@ -485,6 +2016,8 @@ func (s *SessionLoggers) Delete(addr net.Addr) (log.Logger, bool) {
 
 	l, ok := s.loggers[addr]
 	delete(s.loggers, addr)
+	delete(s.stats, addr)
+	delete(s.conns, addr)
 	return l, ok
 }
 
@@ -496,22 +2029,303 @@ func (s *SessionLoggers) Get(addr net.Addr) (log.Logger, bool) {
 	return l, ok
 }
 
+func (s *SessionLoggers) Stats(addr net.Addr) (*SessionStats, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stats, ok := s.stats[addr]
+	return stats, ok
+}
+
+func (s *SessionLoggers) setConn(addr net.Addr, c *SessionConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.conns[addr] = c
+}
+
+// Conn returns the client connection of the session, e.g. to change its
+// deadlines.
+func (s *SessionLoggers) Conn(addr net.Addr) (*SessionConn, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	c, ok := s.conns[addr]
+	return c, ok
+}
+
 type SessionListener struct {
 	l       net.Listener
 	loggers *SessionLoggers
+
+	active sync.WaitGroup // connections that are not closed yet
+
+	logCommandQuirks bool // see log_command_quirks
+
+	limits     ConnLimits
+	mu         sync.Mutex // guards conns, peak and connsPerIP
+	conns      int
+	peak       int // highest value of conns so far
+	connsPerIP map[string]int
+	connRate   *connRateLimiter // nil if connection_rate_per_minute is 0
+	released   chan struct{}    // signaled when a connection is closed, for conn_limit_action block
+
+	// With PROXY protocol, connections are accepted by acceptProxied, which
+	// passes them on once their header has been read
+	proxyProtocol bool
+	proxied       chan net.Conn
+	errs          chan error
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func NewSessionListener(l net.Listener, loggers *SessionLoggers, proxyProtocol bool) *SessionListener {
+	sl := &SessionListener{
+		l:             l,
+		loggers:       loggers,
+		connsPerIP:    make(map[string]int),
+		released:      make(chan struct{}, 1),
+		proxyProtocol: proxyProtocol,
+		proxied:       make(chan net.Conn),
+		errs:          make(chan error),
+		closed:        make(chan struct{}),
+	}
+
+	if proxyProtocol {
+		go sl.acceptProxied()
+	}
+
+	return sl
+}
+
+// ConnLimits limit the number of concurrent client connections, see
+// max_connections, and the rate of new connections per IP, see
+// connection_rate_per_minute.
+type ConnLimits struct {
+	Max           int    // 0 means unlimited
+	PerIP         int    // 0 means unlimited
+	RatePerMinute int    // per IP, 0 means unlimited
+	Action        string // "reject421", "drop" or "block", see conn_limit_action
+	Domain        string // hostname in the 421 reply
 }
 
+// SetLimits sets the connection limits. It must be called before the first
+// Accept.
+func (l *SessionListener) SetLimits(limits ConnLimits) {
+	l.limits = limits
+	if limits.RatePerMinute > 0 {
+		l.connRate = newConnRateLimiter(limits.RatePerMinute)
+	}
+}
+
+// connLimitReplyTimeout limits how long sending the 421 reply to a client over
+// the connection limit may take.
+const connLimitReplyTimeout = 5 * time.Second
+
 func (l *SessionListener) Accept() (net.Conn, error) {
-	c, err := l.l.Accept()
+	var c net.Conn
+	for {
+		if err := l.waitForSlot(); err != nil {
+			return nil, err
+		}
+
+		var err error
+		c, err = l.accept()
+		if err != nil {
+			return nil, err
+		}
+
+		reason := l.acquire(c.RemoteAddr())
+		if reason == "" {
+			break
+		}
+		l.reject(c, reason)
+	}
 
 	logger := l.loggers.New(c.RemoteAddr())
-	if err == nil {
-		logger.Debug("Client connected", "client", c.RemoteAddr())
+	if l.proxyProtocol {
+		logger.Debug("Client connected", "client", c.RemoteAddr(), "proxy", c.(*proxiedConn).Conn.RemoteAddr())
 	} else {
-		logger.Debug("Client connect failed", "client", c.RemoteAddr(), "error", err)
+		logger.Debug("Client connected", "client", c.RemoteAddr())
+	}
+	stats, _ := l.loggers.Stats(c.RemoteAddr())
+
+	addr := c.RemoteAddr()
+	done := func() {
+		l.release(addr)
+		l.active.Done()
+	}
+
+	sc := &SessionConn{c: c, loggers: l.loggers, stats: stats, done: done}
+	if l.logCommandQuirks {
+		sc.quirks = &commandQuirks{log: logger}
+	}
+	l.loggers.setConn(c.RemoteAddr(), sc)
+
+	l.active.Add(1)
+	return sc, nil
+}
+
+// acquire counts a new connection from addr, unless that exceeds the
+// connection limits. It returns the limit that was exceeded, or "".
+func (l *SessionListener) acquire(addr net.Addr) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ip := addrIP(addr)
+	if l.limits.Max > 0 && l.conns >= l.limits.Max {
+		return "max_connections"
+	}
+	if l.limits.PerIP > 0 && l.connsPerIP[ip] >= l.limits.PerIP {
+		return "max_connections_per_ip"
+	}
+	if l.connRate != nil && !l.connRate.allow(ip) {
+		return "connection_rate_per_minute"
+	}
+
+	l.conns++
+	if l.conns > l.peak {
+		l.peak = l.conns
+	}
+	l.connsPerIP[ip]++
+	return ""
+}
+
+func (l *SessionListener) release(addr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ip := addrIP(addr)
+	l.conns--
+	if l.connsPerIP[ip]--; l.connsPerIP[ip] <= 0 {
+		delete(l.connsPerIP, ip)
+	}
+
+	select {
+	case l.released <- struct{}{}:
+	default:
+	}
+}
+
+// waitForSlot blocks while max_connections connections are open, if
+// conn_limit_action is block. New clients wait in the listen backlog of the
+// kernel meanwhile.
+func (l *SessionListener) waitForSlot() error {
+	if l.limits.Action != "block" || l.limits.Max <= 0 {
+		return nil
+	}
+
+	logged := false
+	for {
+		l.mu.Lock()
+		full := l.conns >= l.limits.Max
+		l.mu.Unlock()
+		if !full {
+			return nil
+		}
+
+		if !logged {
+			log.Info("Too many connections, not accepting clients until one disconnects", "max", l.limits.Max)
+			logged = true
+		}
+
+		select {
+		case <-l.released:
+		case <-l.closed:
+			return net.ErrClosed
+		}
+	}
+}
+
+// ConnStats are the numbers of concurrent client connections.
+type ConnStats struct {
+	Current int `json:"current"`
+	Peak    int `json:"peak"`
+}
+
+func (l *SessionListener) Stats() ConnStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return ConnStats{Current: l.conns, Peak: l.peak}
+}
+
+// reject closes a connection over the connection limits. With action
+// reject421 (and block, for the limits other than max_connections) the client
+// is told why first, in the background so a slow client doesn't hold up the
+// others. With drop, it is closed without a reply.
+func (l *SessionListener) reject(c net.Conn, limit string) {
+	log.Info("Too many connections, rejecting client", "client", c.RemoteAddr(), "limit", limit,
+		"action", l.limits.Action)
+
+	if l.limits.Action == "drop" {
+		c.Close()
+		return
+	}
+
+	go func() {
+		c.SetWriteDeadline(time.Now().Add(connLimitReplyTimeout))
+		fmt.Fprintf(c, "421 4.7.0 %s Too many connections, try again later\r\n", l.limits.Domain)
+		c.Close()
+	}()
+}
+
+// addrIP returns the IP of addr, or addr itself if it has no port.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
 	}
+	return host
+}
+
+func (l *SessionListener) accept() (net.Conn, error) {
+	if !l.proxyProtocol {
+		return l.l.Accept()
+	}
+
+	select {
+	case c := <-l.proxied:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	}
+}
+
+// acceptProxied accepts connections and reads their PROXY protocol header in
+// the background, so slow or silent clients don't hold up others. Connections
+// without a valid header are closed.
+func (l *SessionListener) acceptProxied() {
+	for {
+		c, err := l.l.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		go func() {
+			pc, err := readProxyHeader(c)
+			if err != nil {
+				log.Warn("Rejecting connection with invalid PROXY protocol header", "proxy", c.RemoteAddr(),
+					"error", err)
+				c.Close()
+				return
+			}
 
-	return &SessionConn{c: c, loggers: l.loggers}, err
+			select {
+			case l.proxied <- pc:
+			case <-l.closed:
+				c.Close()
+			}
+		}()
+	}
 }
 
 func (l *SessionListener) Addr() net.Addr {
@@ -519,24 +2333,120 @@ func (l *SessionListener) Addr() net.Addr {
 }
 
 func (l *SessionListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
 	return l.l.Close()
 }
 
+// Wait waits until all accepted connections are closed or the timeout expires.
+// It returns false if the timeout expired.
+func (l *SessionListener) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		l.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 type SessionConn struct {
 	c       net.Conn
 	loggers *SessionLoggers
+	stats   *SessionStats
+	quirks  *commandQuirks // nil unless log_command_quirks is set
+
+	done      func() // called once when the connection is closed
+	closeOnce sync.Once
+
+	closing atomic.Bool // close once the next reply is written, see closeAfterReply
+
+	mu      sync.Mutex    // guards reading and drained
+	reading bool          // go-smtp waits for data from the client
+	drained chan struct{} // closed once closeIdle is done, nil until it is called
 }
 
 func (c *SessionConn) Read(b []byte) (n int, err error) {
-	return c.c.Read(b)
+	c.setReading(true)
+	n, err = c.c.Read(b)
+	if drained := c.setReading(false); drained != nil {
+		// Whatever arrived is dropped, the connection is closed by closeIdle,
+		// which has to finish its reply before go-smtp writes again
+		<-drained
+		return 0, net.ErrClosed
+	}
+
+	if c.quirks != nil {
+		c.quirks.read(b[:n])
+	}
+	return n, err
 }
 
 func (c *SessionConn) Write(b []byte) (n int, err error) {
-	return c.c.Write(b)
+	if c.quirks != nil {
+		c.quirks.wrote(b)
+	}
+
+	n, err = c.c.Write(b)
+
+	// The session is cleaned up by go-smtp once its next read fails
+	if err == nil && c.closing.Load() {
+		c.c.Close()
+	}
+
+	return n, err
+}
+
+// setReading records whether go-smtp waits for data from the client. It
+// returns the channel of closeIdle if that took over the connection.
+func (c *SessionConn) setReading(reading bool) chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reading = reading
+	return c.drained
+}
+
+// closeIdle calls reply, which writes the shutdown reply and closes the
+// connection, if go-smtp waits for data from the client. go-smtp doesn't
+// write meanwhile, as a Read returning in between waits for reply to finish.
+// It returns false if go-smtp is busy, or reply was already called.
+func (c *SessionConn) closeIdle(reply func()) bool {
+	c.mu.Lock()
+	if !c.reading || c.drained != nil {
+		c.mu.Unlock()
+		return false
+	}
+	drained := make(chan struct{})
+	c.drained = drained
+	c.mu.Unlock()
+
+	defer close(drained)
+	reply()
+	return true
+}
+
+// closeAfterReply closes the connection once the next reply is written. A
+// server that replies 421 must close the connection (RFC 5321 3.8), but
+// go-smtp keeps reading commands. The reply itself isn't looked at: after
+// STARTTLS, only encrypted records pass through SessionConn. go-smtp flushes
+// each reply on its own, so the next write is the whole reply, or the whole
+// TLS record holding it.
+func (c *SessionConn) closeAfterReply() {
+	c.closing.Store(true)
 }
 
 func (c *SessionConn) Close() error {
+	defer c.closeOnce.Do(c.done)
+
 	err := c.c.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil // already closed after a 421 reply
+	}
 	l, ok := c.loggers.Delete(c.RemoteAddr())
 
 	if ok {
@@ -545,6 +2455,7 @@ func (c *SessionConn) Close() error {
 		} else {
 			l.Debug("Client disconnect failed", "error", err)
 		}
+		c.stats.log(l, c.RemoteAddr().String())
 	}
 
 	return err
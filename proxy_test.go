@@ -0,0 +1,1601 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	log "github.com/inconshreveable/log15"
+)
+
+// holdData makes up hold the reply to the end of each message until release
+// is closed. received gets a value once the message content is in.
+func holdData(up *fakeUpstream) (received chan struct{}, release chan struct{}) {
+	received, release = make(chan struct{}, 10), make(chan struct{})
+	up.setHook(func(c *fakeConn, line string) bool {
+		if line != "DATA" {
+			return false
+		}
+		c.reply("354 go ahead")
+		if _, err := c.readData(); err != nil {
+			return true
+		}
+		received <- struct{}{}
+		<-release
+		c.reply("250 2.0.0 queued")
+		return true
+	})
+	return received, release
+}
+
+func TestMaxConcurrentData(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "max_concurrent_data: 1")
+	received, release := holdData(up)
+
+	first := make(chan error)
+	go func() {
+		c, err := smtpDial(p.addr)
+		if err != nil {
+			first <- err
+			return
+		}
+		defer c.Close()
+		first <- sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage)
+	}()
+	<-received
+
+	c := p.dial(t)
+	err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage)
+	expectSMTPCode(t, err, ErrTooManyTransfers.Code)
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatalf("first transfer: %v", err)
+	}
+
+	// The slot is free again
+	c.Reset()
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatalf("transfer after the first one ended: %v", err)
+	}
+}
+
+func TestClientDisconnectDuringTransaction(t *testing.T) {
+	logs := captureLogs(t)
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "abrupt_disconnect_log_level: warn")
+
+	c := p.dialRaw(t)
+	c.cmd("EHLO client.test")
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<rcpt@example.org>"), "250")
+	c.c.Close()
+
+	// The upstream connection is closed without QUIT, so the upstream server
+	// aborts the transaction
+	eventually(t, "upstream connection closed", func() bool { return up.closedCount() == 1 })
+	for _, verb := range up.verbs() {
+		if verb == "QUIT" || verb == "DATA" {
+			t.Errorf("upstream got %s after the client disconnected", verb)
+		}
+	}
+
+	eventually(t, "disconnect logged", func() bool {
+		return len(logs.lines("lvl=warn", `msg="Client disconnected during transaction"`)) == 1
+	})
+}
+
+func TestRequireHeaders(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), `require_headers: ["From", "Date"]`)
+
+	c := p.dial(t)
+	err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage)
+	expectSMTPCode(t, err, 550)
+	if !strings.Contains(err.Error(), "Date") {
+		t.Errorf("got %q, want the missing header named", err)
+	}
+
+	c.Reset()
+	msg := "Date: Mon, 12 Oct 2026 10:00:00 +0000\r\n" + testMessage
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, msg); err != nil {
+		t.Fatalf("message with all required headers: %v", err)
+	}
+
+	delivered := up.delivered()
+	if len(delivered) != 1 || delivered[0] != msg {
+		t.Errorf("got messages %q upstream, want only %q", delivered, msg)
+	}
+}
+
+func TestUpstreamMaxMessageBytes(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(`"max_message_bytes": "1kb"`))
+	c := p.dial(t)
+
+	// Declared too large
+	if err := c.Mail("sender@example.com", &smtp.MailOptions{Size: 5000}); err != nil {
+		t.Fatal(err)
+	}
+	expectSMTPCode(t, c.Rcpt("rcpt@example.org"), ErrMessageTooLarge.Code)
+	c.Reset()
+
+	// Turns out too large
+	msg := testMessage + strings.Repeat("0123456789abcdef\r\n", 100)
+	err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, msg)
+	expectSMTPCode(t, err, ErrMessageTooLarge.Code)
+	if n := len(up.delivered()); n != 0 {
+		t.Errorf("got %d messages upstream, want none", n)
+	}
+
+	c.Reset()
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatalf("message within the limit: %v", err)
+	}
+}
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "willi.test"))
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "tls_cert: "+certFile, "tls_key: "+keyFile,
+		"shutdown_message: Going down for maintenance", "shutdown_timeout: 10s")
+
+	// One session inside a transaction, a plain and a TLS one idle between
+	// transactions
+	running := p.dial(t)
+	if err := running.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := running.Rcpt("rcpt@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	plain := p.dialRaw(t)
+	plain.cmd("EHLO client.test")
+	expectCode(t, plain.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, plain.cmd("RSET"), "250")
+	encrypted := p.dial(t)
+	if err := encrypted.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encrypted.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := encrypted.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdown(p.config, p.s, p.l, p.be, &Health{})
+		close(stopped)
+	}()
+
+	// Idle sessions get the 421 without sending a command, and are closed
+	expectCode(t, plain.read(), "421 4.3.2 Going down for maintenance")
+	if reply := plain.read(); reply != "EOF" {
+		t.Errorf("got %q after 421, want the connection closed", reply)
+	}
+	var err error
+	eventually(t, "TLS session closed", func() bool {
+		err = encrypted.Noop() // may still be answered if the 421 isn't sent yet
+		return err != nil
+	})
+	expectSMTPCode(t, err, 421)
+
+	// New clients aren't accepted anymore
+	if c, err := net.Dial("tcp", p.addr); err == nil {
+		c.Close()
+		t.Error("connection accepted after shutdown")
+	}
+
+	// The running transaction is completed, then the session is closed too
+	if err := running.Noop(); err != nil {
+		t.Fatalf("NOOP in a transaction started before the shutdown: %v", err)
+	}
+	w, err := running.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, testMessage)
+	if err := w.Close(); err != nil {
+		t.Fatalf("transaction started before the shutdown: %v", err)
+	}
+	eventually(t, "session closed after its transaction", func() bool {
+		err = running.Noop()
+		return err != nil
+	})
+	expectSMTPCode(t, err, 421)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown still waits after all sessions were closed")
+	}
+	if n := len(up.delivered()); n != 1 {
+		t.Errorf("got %d messages upstream, want 1", n)
+	}
+}
+
+func TestLogHeaders(t *testing.T) {
+	logs := captureLogs(t)
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), `log_headers: ["Subject", "Message-ID", "X-Missing"]`,
+		`redact_headers: ["subject"]`)
+
+	c := p.dial(t)
+	msg := "Message-ID: <1234@example.com>\r\n" + testMessage
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := logs.lines(`msg="Message header"`)
+	if len(lines) != 1 {
+		t.Fatalf("got %d header log lines, want 1", len(lines))
+	}
+	for _, want := range []string{"header_subject=<redacted>", "header_message_id=<1234@example.com>"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("header log line %q doesn't contain %s", lines[0], want)
+		}
+	}
+	if strings.Contains(lines[0], "header_x_missing") {
+		t.Errorf("header log line %q contains a missing header", lines[0])
+	}
+
+	// The message itself is passed on unchanged
+	if delivered := up.delivered(); len(delivered) != 1 || delivered[0] != msg {
+		t.Errorf("got messages %q upstream, want %q", delivered, msg)
+	}
+}
+
+func TestUpstreamAuthRetry(t *testing.T) {
+	ca := newTestCA(t)
+	up := startUpstream(t, &fakeUpstream{
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "upstream.test")}},
+		auth:      "relay:secret",
+	})
+
+	// The connection drops during the first AUTH
+	var dropped atomic.Bool
+	up.setHook(func(c *fakeConn, line string) bool {
+		if strings.HasPrefix(line, "AUTH") && !dropped.Swap(true) {
+			c.Close()
+			return true
+		}
+		return false
+	})
+
+	p := startProxy(t, up.static(`"tls_mode": "starttls"`, `"auth_user": "relay"`, `"auth_password": "secret"`),
+		"upstream_dial_retries: 2", "upstream_dial_backoff: 10ms")
+	c := p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatalf("message after a dropped AUTH: %v", err)
+	}
+	if n := up.connCount(); n != 2 {
+		t.Errorf("got %d upstream connections, want 2", n)
+	}
+}
+
+func TestUpstreamAuthRejectedNotRetried(t *testing.T) {
+	ca := newTestCA(t)
+	up := startUpstream(t, &fakeUpstream{
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "upstream.test")}},
+		auth:      "relay:secret",
+	})
+
+	p := startProxy(t, up.static(`"tls_mode": "starttls"`, `"auth_user": "relay"`, `"auth_password": "wrong"`),
+		"upstream_dial_retries: 2", "upstream_dial_backoff: 10ms")
+	c := p.dial(t)
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The 535 is about willi's credentials, the client gets a 450
+	expectSMTPCode(t, c.Rcpt("rcpt@example.org"), 450)
+	if n := up.connCount(); n != 1 {
+		t.Errorf("got %d upstream connections, want 1", n)
+	}
+}
+
+func TestXforward(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		up := startUpstream(t, &fakeUpstream{ext: []string{"XFORWARD NAME ADDR PROTO HELO"}})
+		p := startProxy(t, up.static(), fmt.Sprintf("xforward: %t", enabled))
+
+		c := p.dial(t)
+		if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+			t.Fatal(err)
+		}
+
+		var xforward []string
+		for _, line := range up.received() {
+			if strings.HasPrefix(line, "XFORWARD ") {
+				xforward = append(xforward, line)
+			}
+		}
+		if !enabled {
+			if len(xforward) != 0 {
+				t.Errorf("got %q with xforward disabled", xforward)
+			}
+			continue
+		}
+
+		if len(xforward) != 1 {
+			t.Fatalf("got %q, want one XFORWARD", xforward)
+		}
+		for _, want := range []string{" NAME=", " ADDR=127.0.0.1", " HELO=client.test"} {
+			if !strings.Contains(xforward[0], want) {
+				t.Errorf("%q doesn't contain %q", xforward[0], want)
+			}
+		}
+		if strings.Contains(xforward[0], "PROTO=") {
+			t.Errorf("%q contains PROTO, which willi doesn't know", xforward[0])
+		}
+		if verbs := up.verbs(); verbs[1] != "XFORWARD" || verbs[2] != "MAIL" {
+			t.Errorf("got upstream commands %v, want XFORWARD right before MAIL", verbs)
+		}
+	}
+}
+
+func TestMaxRcptErrors(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	up.setHook(func(c *fakeConn, line string) bool {
+		switch {
+		case strings.HasPrefix(line, "RCPT TO:<unknown"):
+			c.reply("550 5.1.1 No such user")
+		case strings.HasPrefix(line, "RCPT TO:<busy"):
+			c.reply("450 4.2.1 Try again later")
+		default:
+			return false
+		}
+		return true
+	})
+	p := startProxy(t, up.static(), "max_rcpt_errors: 2")
+
+	c := p.dialRaw(t)
+	c.cmd("EHLO client.test")
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<unknown1@example.org>"), "550")
+	expectCode(t, c.cmd("RCPT TO:<rcpt@example.org>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<unknown2@example.org>"), "550")
+
+	// Temporary failures don't count
+	expectCode(t, c.cmd("RCPT TO:<busy@example.org>"), "450")
+
+	expectCode(t, c.cmd("RCPT TO:<unknown3@example.org>"), "421 4.7.0")
+	if reply := c.read(); reply != "EOF" {
+		t.Errorf("got %q after 421, want the connection closed", reply)
+	}
+}
+
+func TestDataWithoutRecipients(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	up.setHook(func(c *fakeConn, line string) bool {
+		if strings.HasPrefix(line, "RCPT TO:<unknown") {
+			c.reply("550 5.1.1 No such user")
+			return true
+		}
+		return false
+	})
+	p := startProxy(t, up.static())
+
+	c := p.dialRaw(t)
+	c.cmd("EHLO client.test")
+
+	// go-smtp answers DATA without accepted recipients itself, Data's check
+	// for them is never reached
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("DATA"), "502 5.5.1")
+	expectCode(t, c.cmd("RSET"), "250")
+
+	// Recipients rejected by the upstream aren't accepted either
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<unknown@example.org>"), "550")
+	expectCode(t, c.cmd("DATA"), "502 5.5.1")
+
+	for _, verb := range up.verbs() {
+		if verb == "DATA" || verb == "BDAT" {
+			t.Errorf("got %s upstream without recipients", verb)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	// 8 KiB at 4 KiB/s with a burst of 4 KiB take a second
+	msg := testMessage + strings.Repeat(strings.Repeat("x", 1022)+"\r\n", 8)
+	const minDuration = 750 * time.Millisecond
+
+	for _, tc := range []struct {
+		option   string
+		sessions int
+	}{
+		{"per_session_rate: 4kb", 1},
+		{"global_rate: 4kb", 2},
+	} {
+		t.Run(tc.option, func(t *testing.T) {
+			up := startUpstream(t, &fakeUpstream{})
+			p := startProxy(t, up.static(), tc.option)
+
+			// Each of the sessions sends half of the message with a global
+			// rate, so the total is the same
+			part := msg
+			if tc.sessions > 1 {
+				part = msg[:len(msg)/tc.sessions]
+			}
+
+			start := time.Now()
+			errs := make(chan error, tc.sessions)
+			for i := 0; i < tc.sessions; i++ {
+				go func() {
+					c, err := smtpDial(p.addr)
+					if err != nil {
+						errs <- err
+						return
+					}
+					defer c.Close()
+					errs <- sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, part+"\r\n")
+				}()
+			}
+			for i := 0; i < tc.sessions; i++ {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if d := time.Since(start); d < minDuration {
+				t.Errorf("sent %d bytes in %v, faster than the rate allows", len(msg), d)
+			}
+			if n := len(up.delivered()); n != tc.sessions {
+				t.Errorf("got %d messages upstream, want %d", n, tc.sessions)
+			}
+		})
+	}
+}
+
+func TestFromAlignment(t *testing.T) {
+	const body = "To: <rcpt@example.org>\r\nSubject: test\r\n\r\nHello\r\n"
+
+	for _, tc := range []struct {
+		name    string
+		mode    string
+		from    string
+		headers string
+		want    int  // 0 if accepted
+		logged  bool // misalignment logged
+	}{
+		{"aligned", "enforce", "sender@example.com", "From: Sender <sender@example.com>\r\n", 0, false},
+		{"subdomain", "enforce", "bounces@mail.example.com", "From: <sender@example.com>\r\n", 0, false},
+		{"misaligned", "enforce", "sender@example.com", "From: <ceo@bank.test>\r\n", ErrFromNotAligned.Code, true},
+		{"one of several misaligned", "enforce", "sender@example.com",
+			"From: <sender@example.com>, <ceo@bank.test>\r\n", ErrFromNotAligned.Code, true},
+		{"bounce", "enforce", "", "From: <mailer-daemon@bank.test>\r\n", 0, false},
+		{"mailing list", "enforce", "owner@lists.example.net",
+			"From: <sender@example.com>\r\nList-Id: <list.example.net>\r\n", 0, false},
+		{"exempt", "enforce", "sender@forwarder.test", "From: <sender@example.com>\r\n", 0, false},
+		{"log only", "log", "sender@example.com", "From: <ceo@bank.test>\r\n", 0, true},
+		{"off", "off", "sender@example.com", "From: <ceo@bank.test>\r\n", 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			up := startUpstream(t, &fakeUpstream{})
+			p := startProxy(t, up.static(), "from_alignment: "+tc.mode,
+				`from_alignment_exempt: ["forwarder.test"]`)
+
+			c := p.dial(t)
+			err := sendMail(c, tc.from, []string{"rcpt@example.org"}, tc.headers+body)
+			if tc.want != 0 {
+				expectSMTPCode(t, err, tc.want)
+				if n := len(up.delivered()); n != 0 {
+					t.Errorf("got %d messages upstream, want none", n)
+				}
+			} else if err != nil {
+				t.Fatalf("got %v, want the message accepted", err)
+			}
+
+			logged := len(logs.lines(`msg="From header not aligned with envelope sender"`)) > 0
+			if logged != tc.logged {
+				t.Errorf("got misalignment logged %t, want %t", logged, tc.logged)
+			}
+		})
+	}
+}
+
+func TestMaxReceivedHops(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "max_received_hops: 3")
+
+	withHops := func(n int) string {
+		return strings.Repeat("Received: from relay.example.com by mx.example.org; Mon, 12 Oct 2026 10:00:00 +0000\r\n", n) +
+			testMessage
+	}
+
+	c := p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, withHops(3)); err != nil {
+		t.Fatalf("message at the hop limit: %v", err)
+	}
+
+	c.Reset()
+	err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, withHops(4))
+	expectSMTPCode(t, err, ErrTooManyHops.Code)
+	if n := len(up.delivered()); n != 1 {
+		t.Errorf("got %d messages upstream, want only the first", n)
+	}
+}
+
+func TestUpstreamLostAfterData(t *testing.T) {
+	for _, tc := range []struct {
+		action string
+		want   int // 0 if accepted
+	}{
+		{"tempfail", ErrUpstreamLostAfterData.Code},
+		{"accept", 0},
+	} {
+		t.Run(tc.action, func(t *testing.T) {
+			logs := captureLogs(t)
+			up := startUpstream(t, &fakeUpstream{})
+			up.setHook(func(c *fakeConn, line string) bool {
+				if line != "DATA" {
+					return false
+				}
+				c.reply("354 go ahead")
+				c.readData()
+				c.Close()
+				return true
+			})
+			p := startProxy(t, up.static(), "upstream_lost_after_data: "+tc.action)
+
+			c := p.dial(t)
+			err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage)
+			if tc.want != 0 {
+				expectSMTPCode(t, err, tc.want)
+			} else if err != nil {
+				t.Fatalf("got %v, want the message accepted", err)
+			}
+
+			if len(logs.lines(`msg="Upstream connection lost after end of DATA`, "action="+tc.action)) != 1 {
+				t.Error("lost connection not logged")
+			}
+		})
+	}
+
+	// A message rejected at the end of DATA isn't ambiguous
+	up := startUpstream(t, &fakeUpstream{})
+	up.setHook(func(c *fakeConn, line string) bool {
+		if line != "DATA" {
+			return false
+		}
+		c.reply("354 go ahead")
+		c.readData()
+		c.reply("554 5.7.1 Spam")
+		return true
+	})
+	p := startProxy(t, up.static(), "upstream_lost_after_data: accept")
+	c := p.dial(t)
+	err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage)
+	expectSMTPCode(t, err, 554)
+}
+
+func TestSessionSummary(t *testing.T) {
+	logs := captureLogs(t)
+	up := startUpstream(t, &fakeUpstream{})
+	var accepted atomic.Bool
+	up.setHook(func(c *fakeConn, line string) bool {
+		if line != "DATA" || !accepted.Swap(true) {
+			return false
+		}
+		c.reply("354 go ahead")
+		c.readData()
+		c.reply("554 5.7.1 Spam")
+		return true
+	})
+	p := startProxy(t, up.static())
+
+	c := p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"a@example.org", "b@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	c.Reset()
+	expectSMTPCode(t, sendMail(c, "sender@example.com", []string{"c@example.org"}, testMessage), 554)
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	eventually(t, "session summary logged", func() bool {
+		lines = logs.lines("lvl=info", `msg="Session finished"`)
+		return len(lines) == 1
+	})
+	for _, want := range []string{
+		"client=127.0.0.1:", "upstream=" + up.addr(), "messages=1 ", "rejected=1 ", "rcpts=3 ",
+		fmt.Sprintf("bytes=%d ", 2*len(testMessage)), "tls=false", "outcome=rejected", "duration=",
+	} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("summary %q doesn't contain %s", lines[0], want)
+		}
+	}
+
+	// A session that ends inside a transaction
+	raw := p.dialRaw(t)
+	raw.cmd("EHLO client.test")
+	expectCode(t, raw.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, raw.cmd("RCPT TO:<rcpt@example.org>"), "250")
+	raw.c.Close()
+	eventually(t, "aborted session logged", func() bool {
+		return len(logs.lines(`msg="Session finished"`, "messages=0 ", "rcpts=1 ", "outcome=aborted")) == 1
+	})
+}
+
+func TestMappingTlsMode(t *testing.T) {
+	ca := newTestCA(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "upstream.test")}}
+	plain := startUpstream(t, &fakeUpstream{tlsConfig: tlsConfig})
+	starttls := startUpstream(t, &fakeUpstream{tlsConfig: tlsConfig})
+	smtps := startUpstream(t, &fakeUpstream{tlsConfig: tlsConfig, smtps: true})
+
+	// The global mode applies to entries without a TLS mode
+	table := filepath.Join(t.TempDir(), "mapping.csv")
+	writeFile(t, table, []byte("key;server;tls_verify;max_message_bytes;tls_mode\n"+
+		"plain@example.org;"+plain.addr()+";false;;none\n"+
+		"starttls@example.org;"+starttls.addr()+";false;;\n"+
+		"smtps@example.org;"+smtps.addr()+";false;;smtps\n"))
+	p := startProxy(t, `mappings: [{"type": "csv", "file": "`+table+`"}]`, "upstream_tls_mode: starttls")
+
+	for _, rcpt := range []string{"plain@example.org", "starttls@example.org", "smtps@example.org"} {
+		c := p.dial(t)
+		if err := sendMail(c, "sender@example.com", []string{rcpt}, testMessage); err != nil {
+			t.Fatalf("message to %s: %v", rcpt, err)
+		}
+		c.Quit()
+	}
+
+	for _, tc := range []struct {
+		name     string
+		up       *fakeUpstream
+		starttls bool
+	}{
+		{"plain", plain, false},
+		{"starttls", starttls, true},
+		{"smtps", smtps, false},
+	} {
+		if n := len(tc.up.delivered()); n != 1 {
+			t.Errorf("%s upstream got %d messages, want 1", tc.name, n)
+		}
+		usedStarttls := false
+		for _, verb := range tc.up.verbs() {
+			usedStarttls = usedStarttls || verb == "STARTTLS"
+		}
+		if usedStarttls != tc.starttls {
+			t.Errorf("%s upstream: got STARTTLS %t, want %t", tc.name, usedStarttls, tc.starttls)
+		}
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "max_header_bytes: 16kb", "max_header_count: 100")
+
+	for _, tc := range []struct {
+		name string
+		msg  string
+		want int // 0 if accepted
+	}{
+		{"long folded field", "X-Folded: x\r\n" + strings.Repeat("\tfolded\r\n", 1<<16) + testMessage,
+			ErrHeaderTooLarge.Code},
+		{"many fields", strings.Repeat("X-Field: x\r\n", 1<<16) + testMessage, ErrHeaderTooLarge.Code},
+		{"large body", testMessage + strings.Repeat("0123456789abcdef\r\n", 1<<14), 0},
+		{"at the limits", strings.Repeat("X-Field: x\r\n", 96) + testMessage, 0},
+	} {
+		c := p.dial(t)
+		err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, tc.msg)
+		if tc.want != 0 {
+			expectSMTPCode(t, err, tc.want)
+		} else if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+
+		// The session survives a rejected message
+		if err := c.Noop(); err != nil {
+			t.Errorf("%s: NOOP after the message: %v", tc.name, err)
+		}
+		c.Close()
+	}
+
+	// go-smtp limits the line length with DATA, but not in BDAT chunks. It
+	// reads ahead of the BDAT command line with the limit still in place, so
+	// the long line doesn't start the chunk.
+	c := p.dialRaw(t)
+	c.cmd("EHLO client.test")
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<rcpt@example.org>"), "250")
+	msg := strings.Repeat("X-Field: "+strings.Repeat("x", 100)+"\r\n", 50) +
+		"X-Long: " + strings.Repeat("x", 1<<20) + "\r\n" + testMessage
+	c.send(fmt.Sprintf("BDAT %d LAST\r\n%s", len(msg), msg))
+	expectCode(t, c.read(), "552 5.3.4 "+ErrHeaderTooLarge.Message)
+	expectCode(t, c.cmd("NOOP"), "250")
+
+	if n := len(up.delivered()); n != 2 {
+		t.Errorf("got %d messages upstream, want 2", n)
+	}
+}
+
+func TestForwardRcptParams(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), `forward_rcpt_params: ["X-CUSTOM", "NOTIFY"]`)
+
+	c := p.dialRaw(t)
+	c.cmd("EHLO client.test")
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<a@example.org> X-Custom=abc+2Bdef X-OTHER=1 NOTIFY=NEVER"), "250")
+	expectCode(t, c.cmd("RCPT TO:<b@example.org> X-OTHER=1"), "250")
+	expectCode(t, c.cmd("RCPT TO:<c@example.org>"), "250")
+
+	var rcpts []string
+	for _, line := range up.received() {
+		if strings.HasPrefix(line, "RCPT") {
+			rcpts = append(rcpts, line)
+		}
+	}
+	want := []string{
+		"RCPT TO:<a@example.org> X-Custom=abc+2Bdef NOTIFY=NEVER",
+		"RCPT TO:<b@example.org>",
+		"RCPT TO:<c@example.org>",
+	}
+	if strings.Join(rcpts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got upstream commands %q, want %q", rcpts, want)
+	}
+}
+
+func TestUpstreamOutOfSync(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		hook func(c *fakeConn, line string) bool
+	}{
+		{"354 to RCPT", func(c *fakeConn, line string) bool {
+			if !strings.HasPrefix(line, "RCPT") {
+				return false
+			}
+			c.reply("354 go ahead")
+			return true
+		}},
+		{"250 to DATA", func(c *fakeConn, line string) bool {
+			if line != "DATA" {
+				return false
+			}
+			c.reply("250 2.0.0 queued")
+			return true
+		}},
+		{"354 to the end of DATA", func(c *fakeConn, line string) bool {
+			if line != "DATA" {
+				return false
+			}
+			c.reply("354 go ahead")
+			c.readData()
+			c.reply("354 go ahead")
+			return true
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			up := startUpstream(t, &fakeUpstream{})
+			up.setHook(tc.hook)
+			p := startProxy(t, up.static())
+
+			c := p.dial(t)
+			err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage)
+			expectSMTPCode(t, err, ErrUpstreamProtocol.Code)
+			if err.(*smtp.SMTPError).EnhancedCode != ErrUpstreamProtocol.EnhancedCode {
+				t.Errorf("got %v, want %v", err, ErrUpstreamProtocol)
+			}
+
+			eventually(t, "upstream connection closed", func() bool { return up.closedCount() == 1 })
+			if len(logs.lines("lvl=warn", `msg="Unexpected reply from upstream server, closing connection"`)) != 1 {
+				t.Error("unexpected reply not logged")
+			}
+
+			// The next transaction gets a new connection
+			up.setHook(nil)
+			c.Reset()
+			if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+				t.Fatalf("transaction after the protocol error: %v", err)
+			}
+			if n := up.connCount(); n != 2 {
+				t.Errorf("got %d upstream connections, want 2", n)
+			}
+		})
+	}
+}
+
+func TestMaxTransactionsPerConnection(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "max_transactions_per_connection: 2", `require_headers: ["Subject"]`)
+
+	c := p.dial(t)
+	for i := 0; i < 2; i++ {
+		// Transactions without DATA don't count
+		if err := c.Mail("sender@example.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Reset(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Neither do rejected messages
+		msg := strings.Replace(testMessage, "Subject: test\r\n", "", 1)
+		err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, msg)
+		expectSMTPCode(t, err, 550)
+		c.Reset()
+
+		if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+			t.Fatalf("transaction %d: %v", i+1, err)
+		}
+	}
+
+	err := c.Mail("sender@example.com", nil)
+	expectSMTPCode(t, err, ErrTooManyTransactions.Code)
+	if err := c.Noop(); err == nil {
+		t.Error("connection still open after 421")
+	}
+	if n := len(up.delivered()); n != 2 {
+		t.Errorf("got %d messages upstream, want 2", n)
+	}
+
+	// The limit is per connection
+	c = p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatalf("transaction in a new connection: %v", err)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	const msg = "Message-ID: <1234@example.com>\r\n" + testMessage
+	const hop = "Received: from a.example.com by b.example.com; Mon, 12 Oct 2026 10:00:0%d +0000\r\n"
+
+	for _, tc := range []struct {
+		action string
+		want   int // reply to a duplicate, 0 if accepted
+	}{
+		{"accept", 0},
+		{"reject", ErrDuplicateMessage.Code},
+	} {
+		t.Run(tc.action, func(t *testing.T) {
+			up := startUpstream(t, &fakeUpstream{})
+			var failed atomic.Bool
+			up.setHook(func(c *fakeConn, line string) bool {
+				// The first attempt fails
+				if line != "DATA" || failed.Swap(true) {
+					return false
+				}
+				c.reply("354 go ahead")
+				c.readData()
+				c.reply("451 4.3.0 try again")
+				return true
+			})
+			p := startProxy(t, up.static(), "dedup_window: 300ms", "dedup_action: "+tc.action)
+			c := p.dial(t)
+			send := func(rcpts []string, msg string) error {
+				c.Reset()
+				return sendMail(c, "sender@example.com", rcpts, msg)
+			}
+			rcpts := []string{"rcpt@example.org", "other@example.org"}
+
+			expectSMTPCode(t, send(rcpts, fmt.Sprintf(hop, 0)+msg), 451)
+			if err := send(rcpts, fmt.Sprintf(hop, 1)+msg); err != nil {
+				t.Fatalf("retry after a failed attempt: %v", err)
+			}
+
+			// Only the hops and the order of the recipients differ
+			err := send([]string{"other@example.org", "rcpt@example.org"}, fmt.Sprintf(hop, 2)+msg)
+			if tc.want != 0 {
+				expectSMTPCode(t, err, tc.want)
+			} else if err != nil {
+				t.Fatalf("duplicate: %v", err)
+			}
+			if n := len(up.delivered()); n != 1 {
+				t.Fatalf("got %d messages upstream after a duplicate, want 1", n)
+			}
+
+			// Not duplicates
+			if err := send(rcpts[:1], msg); err != nil {
+				t.Fatalf("message to fewer recipients: %v", err)
+			}
+			if err := send(rcpts, msg+"PS\r\n"); err != nil {
+				t.Fatalf("message with another body: %v", err)
+			}
+			time.Sleep(300 * time.Millisecond)
+			if err := send(rcpts, msg); err != nil {
+				t.Fatalf("message after the window: %v", err)
+			}
+			if n := len(up.delivered()); n != 4 {
+				t.Errorf("got %d messages upstream, want 4", n)
+			}
+		})
+	}
+}
+
+func TestMappingKey(t *testing.T) {
+	a := startUpstream(t, &fakeUpstream{})
+	b := startUpstream(t, &fakeUpstream{})
+	table := filepath.Join(t.TempDir(), "mapping.csv")
+	writeFile(t, table, []byte("key;server;tls_verify\n"+
+		"example.org;"+a.addr()+";false\n"+
+		"example.net;"+b.addr()+";false\n"+
+		"tenant.test;"+a.addr()+";false\n"+
+		"sender@tenant.test;"+b.addr()+";false\n"))
+	mappings := `mappings: [{"type": "csv", "file": "` + table + `"}]`
+
+	rcpts := func(up *fakeUpstream) []string {
+		var rcpts []string
+		for _, line := range up.received() {
+			if strings.HasPrefix(line, "RCPT") {
+				rcpts = append(rcpts, line)
+			}
+		}
+		return rcpts
+	}
+
+	t.Run("rcpt_domain", func(t *testing.T) {
+		p := startProxy(t, mappings, "mapping_key: rcpt_domain")
+		c := p.dial(t)
+		if err := c.Mail("sender@example.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Rcpt("first@example.org"); err != nil {
+			t.Fatal(err)
+		}
+
+		// A single transaction can only go to one upstream server
+		err := c.Rcpt("other@example.net")
+		expectSMTPCode(t, err, ErrDifferentUpstream.Code)
+		if err.(*smtp.SMTPError).EnhancedCode != ErrDifferentUpstream.EnhancedCode {
+			t.Errorf("got %v, want %v", err, ErrDifferentUpstream)
+		}
+		expectSMTPCode(t, c.Rcpt("unknown@unknown.test"), ErrRelayAccessDenied.Code)
+		if err := c.Rcpt("second@example.org"); err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := c.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, testMessage)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"RCPT TO:<first@example.org>", "RCPT TO:<second@example.org>"}
+		if got := rcpts(a); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("got %q upstream, want %q", got, want)
+		}
+		if n := b.connCount(); n != 0 {
+			t.Errorf("got %d connections to the other upstream, want none", n)
+		}
+
+		// The other recipient can be sent in the next transaction
+		c.Reset()
+		if err := sendMail(c, "sender@example.com", []string{"other@example.net"}, testMessage); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(b.delivered()); n != 1 {
+			t.Errorf("got %d messages at the other upstream, want 1", n)
+		}
+	})
+
+	for _, tc := range []struct {
+		key  string
+		from string
+		up   *fakeUpstream // nil if rejected
+	}{
+		{"from_full", "sender@tenant.test", b},
+		{"from_full", "other@tenant.test", nil},
+		{"from_full", "", nil},
+		{"from_domain", "other@tenant.test", a},
+		{"from_domain", "sender@unknown.test", nil},
+		{"from_domain", "", nil},
+	} {
+		t.Run(tc.key+" <"+tc.from+">", func(t *testing.T) {
+			p := startProxy(t, mappings, "mapping_key: "+tc.key)
+			before := map[*fakeUpstream]int{a: len(a.delivered()), b: len(b.delivered())}
+
+			// The sender decides, by its domain the recipient would go to b
+			c := p.dial(t)
+			err := sendMail(c, tc.from, []string{"rcpt@example.net"}, testMessage)
+			if tc.up == nil {
+				expectSMTPCode(t, err, ErrRelayAccessDenied.Code)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, up := range []*fakeUpstream{a, b} {
+				want := before[up]
+				if up == tc.up {
+					want++
+				}
+				if n := len(up.delivered()); n != want {
+					t.Errorf("upstream %s got %d messages, want %d", up.addr(), n, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	up.setHook(func(c *fakeConn, line string) bool {
+		switch {
+		case strings.HasPrefix(line, "RCPT"):
+			time.Sleep(150 * time.Millisecond)
+			c.reply("250 2.1.5 ok")
+		case line == "DATA":
+			c.reply("354 go ahead")
+			c.readData()
+			time.Sleep(150 * time.Millisecond)
+			c.reply("250 2.0.0 queued")
+		default:
+			return false
+		}
+		return true
+	})
+	p := startProxy(t, up.static(), "slow_log_threshold: 100ms", "loglevel: error")
+
+	// Logged like main does, slow operations get through although the level
+	// is error
+	logs := &logBuffer{}
+	log.Root().SetHandler(logHandler(p.config, logs))
+	t.Cleanup(func() { log.Root().SetHandler(log.DiscardHandler()) })
+
+	c := p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	for _, phase := range []string{"rcpt", "data"} {
+		lines := logs.lines("lvl=warn", `msg="Slow operation"`, "phase="+phase)
+		if len(lines) != 1 {
+			t.Errorf("got %d slow log lines for %s, want 1", len(lines), phase)
+			continue
+		}
+		for _, want := range []string{"component=slow", "sid=", "duration=", "upstream=" + up.addr()} {
+			if !strings.Contains(lines[0], want) {
+				t.Errorf("slow log line %q doesn't contain %s", lines[0], want)
+			}
+		}
+	}
+	for _, phase := range []string{"mail", "connect"} {
+		if lines := logs.lines(`msg="Slow operation"`, "phase="+phase); len(lines) != 0 {
+			t.Errorf("fast %s logged as slow: %q", phase, lines)
+		}
+	}
+	if lines := logs.lines("lvl=info"); len(lines) != 0 {
+		t.Errorf("got info lines with loglevel error: %q", lines)
+	}
+}
+
+func TestMaxRecipientsPerConnection(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	up.setHook(func(c *fakeConn, line string) bool {
+		if strings.HasPrefix(line, "RCPT TO:<unknown") {
+			c.reply("550 5.1.1 No such user")
+			return true
+		}
+		return false
+	})
+	p := startProxy(t, up.static(), "max_recipients: 2", "max_recipients_per_connection: 3")
+
+	c := p.dial(t)
+	// Rejected recipients don't count
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	expectSMTPCode(t, c.Rcpt("unknown@example.org"), 550)
+	c.Reset()
+
+	if err := sendMail(c, "sender@example.com", []string{"a@example.org", "b@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each transaction is within max_recipients, the connection isn't
+	c.Reset()
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("c@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	expectSMTPCode(t, c.Rcpt("d@example.org"), ErrTooManyConnectionRcpts.Code)
+
+	// The recipients accepted so far still get the message
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, testMessage)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Reset()
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	expectSMTPCode(t, c.Rcpt("e@example.org"), ErrTooManyConnectionRcpts.Code)
+
+	// A new connection starts over
+	c = p.dial(t)
+	if err := sendMail(c, "sender@example.com", []string{"e@example.org"}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(up.delivered()); n != 3 {
+		t.Errorf("got %d messages upstream, want 3", n)
+	}
+}
+
+func TestBdatLast(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "chunking_timeout: 200ms")
+
+	c := p.dialRaw(t)
+	c.cmd("EHLO client.test")
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<rcpt@example.org>"), "250")
+	head, body := "Subject: Chunks\r\n\r\n", "First line\r\nSecond line\r\n"
+	c.send(fmt.Sprintf("BDAT %d\r\n%s", len(head), head))
+	expectCode(t, c.read(), "250")
+
+	// Other commands may come between the chunks
+	expectCode(t, c.cmd("NOOP"), "250")
+	if n := len(up.delivered()); n != 0 {
+		t.Fatalf("got %d messages upstream before LAST, want none", n)
+	}
+
+	c.send(fmt.Sprintf("BDAT %d LAST\r\n%s", len(body), body))
+	expectCode(t, c.read(), "250")
+	msgs := up.delivered()
+	if len(msgs) != 1 || !strings.HasSuffix(msgs[0], head+body) {
+		t.Fatalf("got %q upstream, want the chunks as one message", msgs)
+	}
+
+	// RSET instead of the last chunk aborts the upstream transaction
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<rcpt@example.org>"), "250")
+	c.send(fmt.Sprintf("BDAT %d\r\n%s", len(head), head))
+	expectCode(t, c.read(), "250")
+	expectCode(t, c.cmd("RSET"), "250")
+
+	// go-smtp v0.15 sets up the result of a new BDAT transfer while the
+	// aborted one may still be reporting its own, so continue with DATA
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<rcpt@example.org>"), "250")
+	expectCode(t, c.cmd("DATA"), "354")
+	expectCode(t, c.cmd(head+body+"."), "250")
+	if n := len(up.delivered()); n != 2 {
+		t.Errorf("got %d messages upstream, want 2 without the reset one", n)
+	}
+}
+
+func TestBdatMissingLast(t *testing.T) {
+	logs := captureLogs(t)
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "chunking_timeout: 200ms")
+
+	c := p.dialRaw(t)
+	c.cmd("EHLO client.test")
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<rcpt@example.org>"), "250")
+	head := "Subject: Chunks\r\n\r\n"
+	c.send(fmt.Sprintf("BDAT %d\r\n%s", len(head), head))
+	expectCode(t, c.read(), "250")
+
+	// The upstream transaction is aborted at the timeout, the client learns
+	// about it with its next chunk
+	eventually(t, "the aborted upstream transaction", func() bool { return up.closedCount() == 1 })
+	c.send(fmt.Sprintf("BDAT %d LAST\r\n%s", len(testMessage), testMessage))
+	expectCode(t, c.read(), "451 4.4.2 "+ErrChunkingTimeout.Message)
+	if n := len(up.delivered()); n != 0 {
+		t.Errorf("got %d messages upstream, want none", n)
+	}
+	if len(logs.lines(`msg="BDAT transfer timed out, aborting upstream transaction"`, "timeout=200ms")) != 1 {
+		t.Error("timeout not logged")
+	}
+
+	// The session survives
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+	expectCode(t, c.cmd("RCPT TO:<rcpt@example.org>"), "250")
+	c.send(fmt.Sprintf("BDAT %d LAST\r\n%s", len(testMessage), testMessage))
+	expectCode(t, c.read(), "250")
+	if n := len(up.delivered()); n != 1 {
+		t.Errorf("got %d messages upstream, want 1", n)
+	}
+}
+
+func TestLogCommandQuirks(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		logs := captureLogs(t)
+		up := startUpstream(t, &fakeUpstream{})
+		p := startProxy(t, up.static(), fmt.Sprintf("log_command_quirks: %v", enabled))
+
+		c := p.dialRaw(t)
+		expectCode(t, c.cmd("ehlo client.test"), "250")
+		expectCode(t, c.cmd("MAIL  FROM:<sender@example.com>"), "250")
+		c.send("RCPT TO:<a@example.org>\n")
+		expectCode(t, c.read(), "250")
+		expectCode(t, c.cmd("Rcpt to:<b@example.org>"), "250")
+		expectCode(t, c.cmd("NOOP  "), "250")
+
+		// Message content isn't inspected
+		expectCode(t, c.cmd("DATA"), "354")
+		expectCode(t, c.cmd("Subject: test\r\n\r\nmail  from: anyone\r\n."), "250")
+		expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+		expectCode(t, c.cmd("RCPT TO:<a@example.org>"), "250")
+		msg := "Subject: test\r\n\r\nrcpt to: <anyone>\r\n"
+		c.send(fmt.Sprintf("BDAT %d LAST\r\n%s", len(msg), msg))
+		expectCode(t, c.read(), "250")
+		expectCode(t, c.cmd("quit"), "221")
+
+		lines := logs.lines(`msg="Client command with unusual syntax"`)
+		if !enabled {
+			if len(lines) != 0 {
+				t.Errorf("got %q without log_command_quirks", lines)
+			}
+			continue
+		}
+
+		want := []string{
+			"command=EHLO quirks=lowercase_verb",
+			"command=MAIL quirks=repeated_whitespace",
+			"command=RCPT quirks=bare_lf",
+			"command=RCPT quirks=lowercase_verb,lowercase_keyword",
+			"command=NOOP quirks=surrounding_whitespace",
+			"command=QUIT quirks=lowercase_verb",
+		}
+		if len(lines) != len(want) {
+			t.Fatalf("got %d commands logged, want %d: %q", len(lines), len(want), lines)
+		}
+		for i, line := range lines {
+			if !strings.Contains(line, "component=commands") || !strings.Contains(line, want[i]) {
+				t.Errorf("got %q, want %s", line, want[i])
+			}
+		}
+	}
+}
+
+func TestConnLimitAction(t *testing.T) {
+	for _, tc := range []struct {
+		action string
+		limit  string
+		want   string // first reply of the client over the limit, empty if it waits
+	}{
+		{"reject421", "max_connections", "421 4.7.0"},
+		{"reject421", "max_connections_per_ip", "421 4.7.0"},
+		{"drop", "max_connections", "EOF"},
+		{"block", "max_connections", ""},
+		{"block", "max_connections_per_ip", "421 4.7.0"},
+	} {
+		t.Run(tc.action+" "+tc.limit, func(t *testing.T) {
+			logs := captureLogs(t)
+			up := startUpstream(t, &fakeUpstream{})
+			p := startProxy(t, up.static(), tc.limit+": 1", "conn_limit_action: "+tc.action)
+
+			first := p.dialRaw(t)
+			c, err := net.Dial("tcp", p.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			over := &rawClient{t, c, bufio.NewReader(c)}
+
+			if tc.want == "" {
+				// Waits in the backlog until the first client leaves
+				c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				if _, err := over.r.ReadString('\n'); !isTimeout(err) {
+					t.Fatalf("got %v, want no greeting while the first client is connected", err)
+				}
+				first.cmd("QUIT")
+				expectCode(t, over.read(), "220")
+				return
+			}
+
+			expectCode(t, over.read(), tc.want)
+			if tc.want != "EOF" {
+				expectCode(t, over.read(), "EOF")
+			}
+			if len(logs.lines(`msg="Too many connections, rejecting client"`, "limit="+tc.limit,
+				"action="+tc.action)) != 1 {
+				t.Error("rejection not logged")
+			}
+
+			// The first client still works, and once it left, there is room again
+			expectCode(t, first.cmd("NOOP"), "250")
+			expectCode(t, first.cmd("QUIT"), "221")
+			eventually(t, "a free connection slot", func() bool {
+				stats := p.l.Stats()
+				return stats.Current == 0
+			})
+			expectCode(t, p.dialRaw(t).cmd("NOOP"), "250")
+		})
+	}
+}
+
+func TestUpstreamGreetingTimeout(t *testing.T) {
+	for _, mode := range []string{"none", "smtps"} {
+		t.Run(mode, func(t *testing.T) {
+			logs := captureLogs(t)
+
+			// Accepts connections, but never greets or starts TLS
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			closed := make(chan struct{}, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+				closed <- struct{}{}
+			}()
+
+			p := startProxy(t, fmt.Sprintf(`mappings: [{"type": "static", "server": "%s", "tls_verify": false, "tls_mode": "%s"}]`,
+				l.Addr(), mode), "upstream_greeting_timeout: 200ms", "upstream_connect_timeout: 5s")
+
+			c := p.dial(t)
+			if err := c.Mail("sender@example.com", nil); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			expectSMTPCode(t, c.Rcpt("rcpt@example.org"), ErrInternal.Code)
+			if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+				t.Errorf("got the reply after %s, want it after the greeting timeout", d)
+			}
+			if len(logs.lines("no greeting from upstream server within 200ms")) == 0 {
+				t.Error("greeting timeout not logged")
+			}
+
+			// The upstream connection is closed, the session goes on
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Error("upstream connection not closed")
+			}
+			if err := c.Noop(); err != nil {
+				t.Errorf("NOOP after the timeout: %v", err)
+			}
+		})
+	}
+}
+
+func TestInterruptedData(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		stall bool // the client stops sending instead of disconnecting
+	}{
+		{"client disconnects", false},
+		{"client stalls", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			up := startUpstream(t, &fakeUpstream{})
+			p := startProxy(t, up.static(), "data_timeout: 200ms")
+
+			c := p.dialRaw(t)
+			c.cmd("EHLO client.test")
+			expectCode(t, c.cmd("MAIL FROM:<sender@example.com>"), "250")
+			expectCode(t, c.cmd("RCPT TO:<rcpt@example.org>"), "250")
+			expectCode(t, c.cmd("DATA"), "354")
+			c.send("Subject: truncated\r\n\r\n" + strings.Repeat("First part of the body\r\n", 1000))
+			if !tc.stall {
+				c.c.Close()
+			}
+
+			// The upstream connection is closed before the final dot, so the
+			// upstream server discards the partial message
+			eventually(t, "upstream connection closed", func() bool { return up.closedCount() == 1 })
+			if n := len(up.delivered()); n != 0 {
+				t.Errorf("got %d messages upstream, want the truncated one discarded", n)
+			}
+			for _, verb := range up.verbs() {
+				if verb == "QUIT" {
+					t.Error("upstream got QUIT after the interrupted transfer")
+				}
+			}
+			eventually(t, "aborted transfer logged", func() bool {
+				return len(logs.lines(`msg="Message transfer failed, aborting upstream transaction"`)) == 1
+			})
+		})
+	}
+}
+
+func TestRoutingDecision(t *testing.T) {
+	logs := captureLogs(t)
+	a := startUpstream(t, &fakeUpstream{})
+	b := startUpstream(t, &fakeUpstream{})
+	table := filepath.Join(t.TempDir(), "mapping.csv")
+	writeFile(t, table, []byte("key;server;tls_verify\n"+
+		"alice@example.org;"+a.addr()+";false\n"+
+		"bob@example.org;"+a.addr()+";false\n"+
+		"example.org;"+a.addr()+";false\n"))
+	p := startProxy(t,
+		"mappings: [",
+		`  {"type": "csv", "file": "`+table+`"}`,
+		`  {"type": "static", "server": "`+b.addr()+`", "tls_verify": false}`,
+		"]",
+		"recipient_delimiter: +")
+
+	for _, tc := range []struct {
+		rcpt   string
+		fields []string
+	}{
+		{"alice@example.org", []string{"upstream=" + a.addr(), "routing_key=alice@example.org", "mapping=*main.fileMapping",
+			"mapping_index=0", "match=exact", "matched_key=alice@example.org"}},
+		{"bob+news@example.org", []string{"upstream=" + a.addr(), "routing_key=bob+news@example.org",
+			"mapping=*main.fileMapping", "mapping_index=0", "match=without_suffix", "matched_key=bob@example.org"}},
+		// The domain entry is the wildcard for all of its addresses
+		{"carol@example.org", []string{"upstream=" + a.addr(), "routing_key=carol@example.org",
+			"mapping=*main.fileMapping", "mapping_index=0", "match=domain", "matched_key=example.org"}},
+		{"dave@other.test", []string{"upstream=" + b.addr(), "routing_key=dave@other.test",
+			"mapping=*main.staticMapping", "mapping_index=1", "match=catch_all", "matched_key= "}},
+	} {
+		c := p.dial(t)
+		if err := sendMail(c, "sender@example.com", []string{tc.rcpt}, testMessage); err != nil {
+			t.Fatalf("%s: %v", tc.rcpt, err)
+		}
+		c.Close()
+
+		lines := logs.lines(`msg="Routing decision"`, "component=mapping", "to="+tc.rcpt+" ")
+		if len(lines) != 1 {
+			t.Fatalf("%s: got %d routing decisions logged, want 1", tc.rcpt, len(lines))
+		}
+		for _, field := range tc.fields {
+			if !strings.Contains(lines[0]+" ", " "+field) {
+				t.Errorf("%s: got %q, want %s", tc.rcpt, lines[0], field)
+			}
+		}
+	}
+}
+
+func TestRecipientDomains(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), `allowed_recipient_domains: ["example.org", "*.example.net"]`,
+		`denied_recipient_domains: ["legacy.example.net"]`)
+
+	c := p.dial(t)
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		rcpt string
+		ok   bool
+	}{
+		{"a@example.org", true},
+		{"b@legacy.example.net", false}, // denied takes precedence
+		{"c@sub.example.net", true},
+		{"d@example.net", false},
+		{"e@other.test", false},
+		{"F@EXAMPLE.ORG", true},
+	} {
+		err := c.Rcpt(tc.rcpt)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.rcpt, err)
+		}
+		if !tc.ok {
+			if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 {
+				t.Errorf("%s: got %v, want 550", tc.rcpt, err)
+			}
+		}
+	}
+
+	// The message goes to the allowed recipients only
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, testMessage)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var rcpts []string
+	for _, line := range up.received() {
+		if strings.HasPrefix(line, "RCPT") {
+			rcpts = append(rcpts, line)
+		}
+	}
+	want := []string{"RCPT TO:<a@example.org>", "RCPT TO:<c@sub.example.net>", "RCPT TO:<F@EXAMPLE.ORG>"}
+	if strings.Join(rcpts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q upstream, want %q", rcpts, want)
+	}
+	if n := len(up.delivered()); n != 1 {
+		t.Errorf("got %d messages upstream, want 1", n)
+	}
+}
+
+func TestDsnParams(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ext  []string
+		want string // RCPT line upstream
+	}{
+		{"upstream with DSN", []string{"DSN", "SMTPUTF8", "SIZE"},
+			"RCPT TO:<a@example.org> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;a@example.org X-CUSTOM=1"},
+		{"upstream without DSN", []string{"SMTPUTF8", "SIZE"}, "RCPT TO:<a@example.org> X-CUSTOM=1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			up := startUpstream(t, &fakeUpstream{ext: tc.ext})
+			p := startProxy(t, up.static(), `forward_rcpt_params: ["NOTIFY", "ORCPT", "X-CUSTOM"]`,
+				"strip_dsn_params: true")
+
+			c := p.dialRaw(t)
+			c.cmd("EHLO client.test")
+			expectCode(t, c.cmd("MAIL FROM:<sender@example.com> SIZE=100 SMTPUTF8"), "250")
+			expectCode(t, c.cmd("RCPT TO:<a@example.org> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;a@example.org X-CUSTOM=1"), "250")
+
+			var mail, rcpt string
+			for _, line := range up.received() {
+				switch {
+				case strings.HasPrefix(line, "MAIL"):
+					mail = line
+				case strings.HasPrefix(line, "RCPT"):
+					rcpt = line
+				}
+			}
+			if !strings.Contains(mail, " SIZE=100") || !strings.Contains(mail, " SMTPUTF8") {
+				t.Errorf("got %q upstream, want SIZE and SMTPUTF8 passed on", mail)
+			}
+			if rcpt != tc.want {
+				t.Errorf("got %q upstream, want %q", rcpt, tc.want)
+			}
+
+			// go-smtp doesn't support the DSN parameters of MAIL FROM, they are
+			// rejected rather than lost
+			expectCode(t, c.cmd("RSET"), "250")
+			expectCode(t, c.cmd("MAIL FROM:<sender@example.com> RET=HDRS ENVID=QQ314159"), "5")
+		})
+	}
+}
+
+func TestDeclaredSize(t *testing.T) {
+	up := startUpstream(t, &fakeUpstream{ext: []string{"SIZE 1000000"}})
+	p := startProxy(t, up.static(), "max_message_bytes: 1000")
+
+	c := p.dialRaw(t)
+	ehlo := c.cmd("EHLO client.test")
+	advertised := false
+	for _, line := range strings.Split(ehlo, "\n") {
+		advertised = advertised || line[4:] == "SIZE 1000"
+	}
+	if !advertised {
+		t.Errorf("got %q, want SIZE 1000 advertised", ehlo)
+	}
+
+	// Rejected before DATA, and before an upstream server is contacted
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com> SIZE=1001"), "552 5.3.4")
+	if n := up.connCount(); n != 0 {
+		t.Errorf("got %d upstream connections, want none", n)
+	}
+
+	expectCode(t, c.cmd("MAIL FROM:<sender@example.com> SIZE=1000"), "250")
+	expectCode(t, c.cmd("RCPT TO:<rcpt@example.org>"), "250")
+	var mail string
+	for _, line := range up.received() {
+		if strings.HasPrefix(line, "MAIL") {
+			mail = line
+		}
+	}
+	if mail != "MAIL FROM:<sender@example.com> SIZE=1000" {
+		t.Errorf("got %q upstream, want the declared size passed on", mail)
+	}
+	expectCode(t, c.cmd("DATA"), "354")
+	expectCode(t, c.cmd(testMessage+"."), "250")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout limits how long a connection may take to send its PROXY
+// protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaxLength is the maximum length of a v1 header, including CRLF.
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxiedConn is a connection whose PROXY protocol header has been read. It
+// reports the client address from the header as its remote address.
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header of c. A header
+// without a client address (v1 UNKNOWN, v2 LOCAL or a family other than
+// TCP over IPv4/IPv6) keeps the address of the connection itself.
+func readProxyHeader(c net.Conn) (*proxiedConn, error) {
+	if err := c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(c)
+	pc := &proxiedConn{Conn: c, r: r, remote: c.RemoteAddr()}
+
+	// The shortest v1 header ("PROXY UNKNOWN\r\n") is longer than the v2
+	// signature
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	var addr net.Addr
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		addr, err = readProxyV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		addr, err = readProxyV1(r)
+	default:
+		err = errors.New("missing header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr != nil {
+		pc.remote = addr
+	}
+
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address %q in v1 header", fields[2])
+	}
+	if net.ParseIP(fields[3]) == nil {
+		return nil, fmt.Errorf("invalid destination address %q in v1 header", fields[3])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q in v1 header", fields[4])
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid destination port %q in v1 header", fields[5])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading v2 header: %w", err)
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 header version %d", hdr[12]>>4)
+	}
+	command := hdr[12] & 0x0f
+	if command > 1 {
+		return nil, fmt.Errorf("unsupported v2 header command %d", command)
+	}
+
+	// The address block is followed by TLVs, which are skipped
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading v2 header: %w", err)
+	}
+
+	if command == 0 { // LOCAL, e.g. health checks of the load balancer
+		return nil, nil
+	}
+
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("v2 header too short for IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("v2 header too short for IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
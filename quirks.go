@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// maxCommandLength limits the buffered command line, longer lines are skipped.
+// RFC 5321 allows 512 bytes, go-smtp more.
+const maxCommandLength = 2048
+
+// commandQuirks inspects the commands a client sends before go-smtp parses
+// them, and logs those that go-smtp only accepts because it is lenient:
+// lowercase verbs, bare LF line endings, extra whitespace. Message content
+// (DATA and BDAT chunks) is skipped. After STARTTLS, the connection carries
+// TLS records and inspection stops.
+type commandQuirks struct {
+	log log.Logger
+
+	line     []byte
+	overflow bool  // line exceeded maxCommandLength, skip until its end
+	data     bool  // inside DATA, until the final dot
+	skip     int64 // bytes of a BDAT chunk still to skip
+	verb     string
+	stopped  bool
+}
+
+// read inspects bytes read from the client.
+func (q *commandQuirks) read(b []byte) {
+	for len(b) > 0 && !q.stopped {
+		if q.skip > 0 {
+			n := int64(len(b))
+			if n > q.skip {
+				n = q.skip
+			}
+			q.skip -= n
+			b = b[n:]
+			continue
+		}
+
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			q.append(b)
+			return
+		}
+		q.append(b[:i+1])
+		b = b[i+1:]
+
+		if !q.overflow {
+			q.command(q.line)
+		}
+		q.line = q.line[:0]
+		q.overflow = false
+	}
+}
+
+func (q *commandQuirks) append(b []byte) {
+	if q.overflow || len(q.line)+len(b) > maxCommandLength {
+		q.overflow = true
+		q.line = q.line[:0]
+		return
+	}
+	q.line = append(q.line, b...)
+}
+
+// wrote inspects replies sent to the client, which tell whether the client
+// is about to send message content or start TLS.
+func (q *commandQuirks) wrote(b []byte) {
+	switch {
+	case q.verb == "DATA" && bytes.HasPrefix(b, []byte("354")):
+		q.data = true
+	case q.verb == "STARTTLS" && bytes.HasPrefix(b, []byte("220")):
+		q.stopped = true
+	}
+}
+
+func (q *commandQuirks) command(line []byte) {
+	if q.data {
+		if bytes.Equal(bytes.TrimRight(line, "\r\n"), []byte(".")) {
+			q.data = false
+		}
+		return
+	}
+
+	quirks := make([]string, 0)
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		quirks = append(quirks, "bare_lf")
+	}
+
+	text := strings.TrimRight(string(line), "\r\n")
+	if strings.TrimSpace(text) != text {
+		quirks = append(quirks, "surrounding_whitespace")
+	}
+
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		q.verb = ""
+		return
+	}
+	q.verb = strings.ToUpper(fields[0])
+
+	if fields[0] != q.verb {
+		quirks = append(quirks, "lowercase_verb")
+	}
+	if strings.Join(fields, " ") != strings.TrimSpace(text) {
+		quirks = append(quirks, "repeated_whitespace")
+	}
+
+	args := strings.TrimSpace(strings.TrimSpace(text)[len(fields[0]):])
+	switch q.verb {
+	case "MAIL", "RCPT":
+		if colon := strings.IndexByte(args, ':'); colon >= 0 {
+			keyword := args[:colon]
+			if keyword != strings.ToUpper(keyword) {
+				quirks = append(quirks, "lowercase_keyword")
+			}
+			if strings.HasPrefix(args[colon+1:], " ") {
+				quirks = append(quirks, "space_after_colon")
+			}
+		}
+	case "BDAT":
+		if len(fields) > 1 {
+			if size, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				q.skip = size
+			}
+		}
+	}
+
+	if len(quirks) > 0 {
+		q.log.Debug("Client command with unusual syntax", componentKey, "commands", "command", q.verb,
+			"quirks", strings.Join(quirks, ","))
+	}
+}
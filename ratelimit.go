@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting throughput to rate bytes per second,
+// with bursts of up to one second worth of bytes. It is safe for concurrent
+// use, so a single limiter can be shared between sessions.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller has
+// to wait until they are covered. The bucket may go into debt, which makes
+// concurrent callers queue up behind each other.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// burst returns the maximum number of bytes that should be read at once.
+func (l *RateLimiter) burst() int {
+	if l.rate < 1 {
+		return 1
+	}
+	return int(l.rate)
+}
+
+// rateLimitedReader delays reads so that all of its limiters stay within
+// their rate.
+type rateLimitedReader struct {
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+func newRateLimitedReader(r io.Reader, limiters ...*RateLimiter) io.Reader {
+	active := make([]*RateLimiter, 0, len(limiters))
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+
+	if len(active) == 0 {
+		return r
+	}
+
+	return &rateLimitedReader{r: r, limiters: active}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	for _, l := range r.limiters {
+		if b := l.burst(); len(p) > b {
+			p = p[:b]
+		}
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		var wait time.Duration
+		for _, l := range r.limiters {
+			if d := l.reserve(n); d > wait {
+				wait = d
+			}
+		}
+		time.Sleep(wait)
+	}
+
+	return n, err
+}
+
+// connRateLimiter limits the rate of new connections per client IP to rate
+// per minute, with bursts of up to one minute worth of connections. Buckets
+// that are full again are pruned, so IPs that stopped connecting don't take
+// up memory.
+type connRateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // connections per minute
+	buckets   map[string]*connBucket
+	lastPrune time.Time
+}
+
+type connBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// connRatePruneInterval is the minimum time between two prunes of the buckets.
+const connRatePruneInterval = time.Minute
+
+func newConnRateLimiter(ratePerMinute int) *connRateLimiter {
+	return &connRateLimiter{
+		rate:      float64(ratePerMinute),
+		buckets:   make(map[string]*connBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow takes a connection from the bucket of ip and returns false if it is
+// empty.
+func (l *connRateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) >= connRatePruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &connBucket{tokens: l.rate, last: now}
+		l.buckets[ip] = b
+	}
+	b.refill(now, l.rate)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *connRateLimiter) prune(now time.Time) {
+	for ip, b := range l.buckets {
+		if b.refill(now, l.rate); b.tokens >= l.rate {
+			delete(l.buckets, ip)
+		}
+	}
+	l.lastPrune = now
+}
+
+func (b *connBucket) refill(now time.Time, rate float64) {
+	b.tokens += now.Sub(b.last).Minutes() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+}
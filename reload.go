@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// restartOptions can't be changed by a reload, they are used to set up the
+// listeners, the SMTP server or state that outlives sessions.
+var restartOptions = []string{
+	"listen", "proxy_protocol", "log_command_quirks", "domain",
+	"max_connections", "max_connections_per_ip", "connection_rate_per_minute",
+	"conn_limit_action",
+	"tls_cert", "tls_key", "tls_certs", "tls_alpn", "tls_server_names",
+	"tls_min_version", "tls_max_version", "tls_cipher_suites", "acme",
+	"require_client_cert", "client_ca_file",
+	"command_timeout", "write_timeout", "max_message_bytes", "max_recipients",
+	"max_idle_per_upstream", "min_idle_per_upstream", "idle_timeout", "pool_reap_interval", "dedup_window",
+	"accounting_url",
+	"debug_listen", "health_listen", "upstream_error_history", "auxiliary_bind_fatal",
+}
+
+// configure builds the sessionOptions of config for new sessions. Running
+// sessions keep the options they started with. Except during setup, b.mu must
+// be held.
+func (b *ProxyBackend) configure(config *Config) {
+	sourceAddrs := make([]net.IP, len(config.UpstreamSourceAddresses))
+	for i, addr := range config.UpstreamSourceAddresses {
+		sourceAddrs[i] = net.ParseIP(addr)
+	}
+
+	o := &sessionOptions{
+		domain:   config.Domain,
+		mappings: config.Mappings,
+		resolver: NewResolver(config.DnsServers, time.Duration(config.DnsTimeout), DialOptions{
+			Timeout:     time.Duration(config.UpstreamConnectTimeout),
+			KeepAlive:   time.Duration(config.UpstreamKeepAlive),
+			SourceAddrs: sourceAddrs,
+		}),
+
+		mappingKey:         config.MappingKey,
+		requireStarttls:    config.RequireStarttls,
+		requireClientCert:  config.RequireClientCert,
+		recipientDelimiter: config.RecipientDelimiter,
+		requireHeaders:     config.RequireHeaders,
+		logHeaders:         config.LogHeaders,
+		redactHeaders:      config.RedactHeaders,
+		fromAlignment:      config.FromAlignment,
+		fromAlignExempt:    config.FromAlignmentExempt,
+		allowedSenders:     config.AllowedSenderDomains,
+		allowedRcpts:       config.AllowedRecipientDomains,
+		deniedRcpts:        config.DeniedRecipientDomains,
+		maxReceivedHops:    config.MaxReceivedHops,
+		maxHeaderBytes:     int(config.MaxHeaderBytes),
+		maxHeaderCount:     config.MaxHeaderCount,
+		forwardRcptParams:  config.ForwardRcptParams,
+		stripDsnParams:     config.StripDsnParams,
+		xforward:           config.XForward,
+		addReceivedHeader:  config.AddReceivedHeader,
+		dkim:               config.DkimOptions,
+		maxRcptErrors:      config.MaxRcptErrors,
+		maxMessageBytes:    int(config.MaxMessageBytes),
+		maxTransactions:    config.MaxTransactions,
+		maxConnectionRcpts: config.MaxConnectionRcpts,
+		perSessionRate:     int(config.PerSessionRate),
+
+		dialRetries:      config.UpstreamDialRetries,
+		dialBackoff:      time.Duration(config.UpstreamDialBackoff),
+		upstreamAffinity: config.UpstreamAffinity,
+		upstreamTlsMode:  TlsMode(config.UpstreamTlsMode),
+		fullFailover:     config.UpstreamFullFailover,
+		greetingTimeout:  time.Duration(config.UpstreamGreetingTimeout),
+		upstreamTimeout:  time.Duration(config.UpstreamTimeout),
+
+		lostAfterData:   config.LostAfterData,
+		chunkingTimeout: time.Duration(config.ChunkingTimeout),
+		dataTimeout:     time.Duration(config.DataTimeout),
+		commandTimeout:  time.Duration(config.CommandTimeout),
+		dedupAction:     config.DedupAction,
+
+		abruptDisconnectLogLevel: log.Lvl(config.AbruptDisconnectLogLevel),
+		slowThreshold:            time.Duration(config.SlowLogThreshold),
+
+		shutdownMessage: config.ShutdownMessage,
+	}
+
+	// Keep the limiters if their limit didn't change, a new one would start
+	// with a full bucket or free slots.
+	if old := b.opts; old != nil && old.dataSlots != nil && cap(old.dataSlots) == config.MaxConcurrentData {
+		o.dataSlots = old.dataSlots
+	} else if config.MaxConcurrentData > 0 {
+		o.dataSlots = make(chan struct{}, config.MaxConcurrentData)
+	}
+
+	if old := b.opts; old != nil && old.globalRate != nil && old.globalRate.rate == float64(config.GlobalRate) {
+		o.globalRate = old.globalRate
+	} else if config.GlobalRate > 0 {
+		o.globalRate = NewRateLimiter(int(config.GlobalRate))
+	}
+
+	b.config = config
+	b.opts = o
+}
+
+// Reload applies config to new sessions. The mappings of the previous config
+// are closed once all sessions that may use them are finished.
+func (b *ProxyBackend) Reload(config *Config) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	mappings, sessions := b.opts.mappings, b.sessions
+	b.sessions = &sync.WaitGroup{}
+	b.configure(config)
+
+	go func() {
+		sessions.Wait()
+		closeMappings(mappings)
+	}()
+}
+
+// Config returns the config currently used for new sessions.
+func (b *ProxyBackend) Config() *Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.config
+}
+
+func closeMappings(mappings []Mapping) {
+	for _, mapping := range mappings {
+		if c, ok := mapping.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Warn("Failed to close mapping", "mapping", mapping, "error", err)
+			}
+		}
+	}
+}
+
+// keepRestartOptions sets the restartOptions of config to their values in
+// running and returns the keys of those that differed.
+func keepRestartOptions(running *Config, config *Config) []string {
+	changed := make([]string, 0)
+
+	r := reflect.ValueOf(running).Elem()
+	c := reflect.ValueOf(config).Elem()
+	for i := 0; i < c.NumField(); i++ {
+		key, _, _ := strings.Cut(c.Type().Field(i).Tag.Get("json"), ",")
+		for _, option := range restartOptions {
+			if key == option && !reflect.DeepEqual(r.Field(i).Interface(), c.Field(i).Interface()) {
+				c.Field(i).Set(r.Field(i))
+				changed = append(changed, key)
+			}
+		}
+	}
+
+	return changed
+}
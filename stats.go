@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// SessionStats collects the numbers of one client connection for the summary
+// log line written when the connection is closed.
+type SessionStats struct {
+	mu sync.Mutex
+
+	connected time.Time
+	upstreams []string
+	messages  int // messages accepted by upstream servers
+	rejected  int // messages rejected during DATA
+	rcpts     int // recipients accepted by upstream servers
+	bytes     int64
+	outcome   string
+	tls       bool // the client used STARTTLS
+}
+
+func NewSessionStats() *SessionStats {
+	return &SessionStats{connected: time.Now(), outcome: "no_message"}
+}
+
+func (s *SessionStats) addUpstream(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, upstream := range s.upstreams {
+		if upstream == server {
+			return
+		}
+	}
+	s.upstreams = append(s.upstreams, server)
+}
+
+func (s *SessionStats) setTls() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tls = true
+}
+
+func (s *SessionStats) addRcpt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rcpts++
+}
+
+// addMessage records the result of a DATA command.
+func (s *SessionStats) addMessage(bytes int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bytes += bytes
+	if err == nil {
+		s.messages++
+		s.outcome = "accepted"
+	} else {
+		s.rejected++
+		s.outcome = "rejected"
+	}
+}
+
+// abort records that the client disconnected during a transaction.
+func (s *SessionStats) abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.outcome = "aborted"
+}
+
+func (s *SessionStats) log(logger log.Logger, client string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	logger.Info("Session finished", "client", client,
+		"duration", time.Since(s.connected).Round(time.Millisecond),
+		"upstream", strings.Join(s.upstreams, ","),
+		"messages", s.messages, "rejected", s.rejected, "rcpts", s.rcpts, "bytes", s.bytes,
+		"tls", s.tls, "outcome", s.outcome)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// tlsVersions are the names of the versions allowed in tls_min_version and
+// tls_max_version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsDefaultCipherSuites are the TLS 1.0-1.2 cipher suites offered to clients
+// unless tls_cipher_suites is set: forward secrecy and AEAD only. TLS 1.3
+// suites are not configurable in Go and always secure.
+var tlsDefaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// applyTlsVersions sets the protocol versions and cipher suites of cfg from
+// tls_min_version, tls_max_version and tls_cipher_suites. Cipher suites are
+// given by their IANA names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Those
+// that Go considers insecure (RC4, 3DES, ...) are allowed for old clients, but
+// must be listed explicitly.
+func applyTlsVersions(cfg *tls.Config, config *Config) error {
+	min, ok := tlsVersions[config.TlsMinVersion]
+	if !ok {
+		return fmt.Errorf("tls_min_version must be one of '1.0', '1.1', '1.2', '1.3' but was '%s'", config.TlsMinVersion)
+	}
+
+	var max uint16
+	if config.TlsMaxVersion != "" {
+		if max, ok = tlsVersions[config.TlsMaxVersion]; !ok {
+			return fmt.Errorf("tls_max_version must be one of '1.0', '1.1', '1.2', '1.3' but was '%s'",
+				config.TlsMaxVersion)
+		}
+		if max < min {
+			return fmt.Errorf("tls_max_version must not be lower than tls_min_version")
+		}
+	}
+
+	suites := tlsDefaultCipherSuites
+	if len(config.TlsCipherSuites) > 0 {
+		known := make(map[string]uint16)
+		for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			known[s.Name] = s.ID
+		}
+
+		suites = nil
+		for _, name := range config.TlsCipherSuites {
+			id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+			if !ok {
+				return fmt.Errorf("tls_cipher_suites: unknown cipher suite '%s'", name)
+			}
+			suites = append(suites, id)
+		}
+	}
+
+	cfg.MinVersion = min
+	cfg.MaxVersion = max
+	cfg.CipherSuites = suites
+	return nil
+}
+
+// loadTlsCertificates returns the TLS config with the certificates of tls_cert
+// and tls_certs, or nil if tls_cert isn't set.
+func loadTlsCertificates(config *Config) (*tls.Config, error) {
+	if config.TlsCert == "" || config.TlsKey == "" {
+		return nil, nil
+	}
+
+	cer, err := tls.LoadX509KeyPair(config.TlsCert, config.TlsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []tls.Certificate{cer}
+	hostCerts := make([]hostCertificate, 0)
+	for _, c := range config.TlsCerts {
+		cer, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Cert, err)
+		}
+		certs = append(certs, cer)
+		if c.Host != "" {
+			hostCerts = append(hostCerts, hostCertificate{c.Host, &cer})
+		}
+	}
+
+	cfg := &tls.Config{
+		Certificates: certs,
+		NextProtos:   config.TlsAlpn,
+	}
+	if len(hostCerts) > 0 {
+		cfg.GetCertificate = certificateByHost(hostCerts)
+	}
+	applyTlsVersions(cfg, config) // validated by loadConfigFile
+
+	return cfg, nil
+}
+
+// requireClientCerts makes cfg require client certificates signed by the CAs
+// in client_ca_file, if require_client_cert is set.
+func requireClientCerts(cfg *tls.Config, config *Config) error {
+	if !config.RequireClientCert {
+		return nil
+	}
+
+	pool, err := loadCertPool(config.ClientCaFile)
+	if err != nil {
+		return err
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.ClientCAs = pool
+
+	return nil
+}
+
+// loadCertPool reads the PEM encoded CA certificates in file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	d, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(d) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+	return pool, nil
+}
+
+// clientCertName returns the subject common name of the verified certificate
+// of a client, and whether it has one.
+func clientCertName(state tls.ConnectionState) (string, bool) {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+	return state.PeerCertificates[0].Subject.CommonName, true
+}
+
+// hostCertificate is a certificate that is used for the server names matching
+// host, see tls_certs.
+type hostCertificate struct {
+	host string
+	cert *tls.Certificate
+}
+
+// certificateByHost returns a tls.Config.GetCertificate callback that selects
+// the first certificate whose host matches the server name (SNI) the client
+// asks for. Otherwise, tls.Config.Certificates is used, which selects a
+// certificate by the names it is valid for, or the first one.
+func certificateByHost(certs []hostCertificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			return nil, nil
+		}
+
+		for _, c := range certs {
+			if serverNameAllowed(hello.ServerName, []string{c.host}) {
+				return c.cert, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// serverNameFilter returns a tls.Config.GetConfigForClient callback that fails
+// the handshake if the client asks for a server name (SNI) that is not in
+// allowed. Clients that don't send SNI are accepted, many MTAs don't.
+func serverNameFilter(allowed []string, loggers *SessionLoggers) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if hello.ServerName == "" || serverNameAllowed(hello.ServerName, allowed) {
+			return nil, nil // use the default config
+		}
+
+		logger, ok := loggers.Get(hello.Conn.RemoteAddr())
+		if !ok {
+			logger = log.New("sid", "", componentKey, "proxy")
+		}
+		logger.Info("Rejecting TLS handshake for unknown server name", "client", hello.Conn.RemoteAddr(),
+			"sni", hello.ServerName)
+
+		return nil, fmt.Errorf("unknown server name '%s'", hello.ServerName)
+	}
+}
+
+// serverNameAllowed reports whether name matches one of patterns. A pattern
+// "*.example.com" matches exactly one label in front of example.com.
+func serverNameAllowed(name string, patterns []string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+
+		if strings.HasPrefix(pattern, "*.") {
+			label, rest, ok := strings.Cut(name, ".")
+			if ok && label != "" && rest == pattern[2:] {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pinMismatchError is returned if an upstream server's certificate doesn't
+// match the pinned fingerprint.
+type pinMismatchError struct {
+	fingerprint string
+}
+
+func (e *pinMismatchError) Error() string {
+	return fmt.Sprintf("certificate fingerprint %s does not match pinned fingerprint", e.fingerprint)
+}
+
+// upstreamTlsConfig returns the TLS config for connections to upstream at
+// host, according to its tls_verify and tls_pin.
+func upstreamTlsConfig(host string, upstream Upstream) *tls.Config {
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: !upstream.TlsVerify,
+	}
+	if upstream.TlsPin != "" {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verifyPin(upstream.TlsPin)
+	}
+	return cfg
+}
+
+// verifyPin returns a tls.Config.VerifyPeerCertificate callback that accepts
+// the connection if the SHA-256 fingerprint of the server's (leaf) certificate
+// is pin. It is used with InsecureSkipVerify, so a pinned self-signed or
+// expired certificate is accepted.
+func verifyPin(pin string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no certificate presented")
+		}
+
+		sum := sha256.Sum256(rawCerts[0])
+		if fingerprint := hex.EncodeToString(sum[:]); fingerprint != pin {
+			return &pinMismatchError{fingerprint: fingerprint}
+		}
+
+		return nil
+	}
+}
+
+// tlsVerifyFailure reports whether err is a failed verification of an upstream
+// server's certificate, and why: "expired" (or not valid yet),
+// "hostname_mismatch", "unknown_ca", "pin_mismatch" or "invalid" for other
+// reasons.
+func tlsVerifyFailure(err error) (string, bool) {
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var unknown x509.UnknownAuthorityError
+	var pin *pinMismatchError
+
+	switch {
+	case errors.As(err, &pin):
+		return "pin_mismatch", true
+	case errors.As(err, &invalid):
+		if invalid.Reason == x509.Expired {
+			return "expired", true
+		}
+		return "invalid", true
+	case errors.As(err, &hostname):
+		return "hostname_mismatch", true
+	case errors.As(err, &unknown):
+		return "unknown_ca", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestTlsServerNames(t *testing.T) {
+	logs := captureLogs(t)
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "default.test"))
+	mxCertFile, mxKeyFile := writeCertFiles(t, ca.issue(t, "mx.example.com"))
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "tls_cert: "+certFile, "tls_key: "+keyFile,
+		fmt.Sprintf(`tls_certs: [{"host": "mx.example.com", "cert": "%s", "key": "%s"}]`, mxCertFile, mxKeyFile),
+		`tls_server_names: ["mx.example.com", "*.example.net"]`)
+
+	for _, tc := range []struct {
+		sni  string
+		cert string // CN of the certificate presented, empty if rejected
+	}{
+		{"mx.example.com", "mx.example.com"},
+		{"MX.example.com", "mx.example.com"},
+		{"a.example.net", "default.test"},
+		{"", "default.test"}, // many MTAs don't send SNI
+		{"b.a.example.net", ""},
+		{"unknown.test", ""},
+	} {
+		c := p.dial(t)
+		err := c.StartTLS(&tls.Config{ServerName: tc.sni, InsecureSkipVerify: true})
+		if tc.cert == "" {
+			if err == nil {
+				t.Errorf("SNI %q: handshake succeeded, want it rejected", tc.sni)
+			}
+			if len(logs.lines(`msg="Rejecting TLS handshake for unknown server name"`, "sni="+tc.sni)) != 1 {
+				t.Errorf("SNI %q: rejection not logged", tc.sni)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("SNI %q: %v", tc.sni, err)
+			continue
+		}
+		state, _ := c.TLSConnectionState()
+		if cn := state.PeerCertificates[0].Subject.CommonName; cn != tc.cert {
+			t.Errorf("SNI %q: got certificate %s, want %s", tc.sni, cn, tc.cert)
+		}
+		if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+			t.Errorf("SNI %q: %v", tc.sni, err)
+		}
+		c.Close()
+	}
+}
+
+func TestUpstreamTlsVerifyFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		ca     *testCA
+		modify func(*x509.Certificate)
+		reason string // empty if the certificate is valid
+	}{
+		{"valid", systemCA, nil, ""},
+		{"unknown CA", newTestCA(t), nil, "unknown_ca"},
+		{"expired", systemCA, func(c *x509.Certificate) {
+			c.NotBefore, c.NotAfter = time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour)
+		}, "expired"},
+		{"hostname mismatch", systemCA, func(c *x509.Certificate) {
+			c.DNSNames, c.IPAddresses = []string{"other.test"}, nil
+		}, "hostname_mismatch"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cert := tc.ca.issueWith(t, "upstream.test", tc.modify)
+			up := startUpstream(t, &fakeUpstream{tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+			p := startProxy(t, fmt.Sprintf(`mappings: [{"type": "static", "server": "%s", "tls_verify": true, "tls_mode": "starttls"}]`,
+				up.addr()))
+
+			c := p.dial(t)
+			err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage)
+			if tc.reason == "" {
+				if err != nil {
+					t.Fatalf("valid certificate: %v", err)
+				}
+				return
+			}
+
+			expectSMTPCode(t, err, ErrUpstreamTlsVerify.Code)
+			if err.(*smtp.SMTPError).EnhancedCode != ErrUpstreamTlsVerify.EnhancedCode {
+				t.Errorf("got %v, want %v", err, ErrUpstreamTlsVerify)
+			}
+			if len(logs.lines("lvl=warn", `msg="TLS certificate verification of upstream server failed"`,
+				"reason="+tc.reason)) != 1 {
+				t.Errorf("verification failure with reason %s not logged", tc.reason)
+			}
+			if n := len(up.delivered()); n != 0 {
+				t.Errorf("got %d messages upstream, want none", n)
+			}
+		})
+	}
+}
+
+func TestUpstreamTlsPin(t *testing.T) {
+	// Neither trusted nor valid, only the pin makes it acceptable
+	cert := newTestCA(t).issueWith(t, "upstream.test", func(c *x509.Certificate) {
+		c.NotBefore, c.NotAfter = time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour)
+	})
+	sum := sha256.Sum256(cert.Certificate[0])
+	pin := strings.ToUpper(hex.EncodeToString(sum[:]))
+	var colons []string
+	for i := 0; i < len(pin); i += 2 {
+		colons = append(colons, pin[i:i+2])
+	}
+
+	for _, tc := range []struct {
+		name string
+		pin  string
+		ok   bool
+	}{
+		{"matching", pin, true},
+		{"matching with colons", strings.Join(colons, ":"), true},
+		{"mismatching", strings.Repeat("ab", 32), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			up := startUpstream(t, &fakeUpstream{tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+			p := startProxy(t, fmt.Sprintf(`mappings: [{"type": "static", "server": "%s", "tls_verify": true, "tls_mode": "starttls", "tls_pin": "%s"}]`,
+				up.addr(), tc.pin))
+
+			c := p.dial(t)
+			err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage)
+			if tc.ok {
+				if err != nil {
+					t.Fatalf("pinned certificate: %v", err)
+				}
+				if n := len(up.delivered()); n != 1 {
+					t.Errorf("got %d messages upstream, want 1", n)
+				}
+				return
+			}
+
+			expectSMTPCode(t, err, ErrUpstreamTlsVerify.Code)
+			if len(logs.lines(`msg="TLS certificate verification of upstream server failed"`, "reason=pin_mismatch")) != 1 {
+				t.Error("pin mismatch not logged")
+			}
+			if n := len(up.delivered()); n != 0 {
+				t.Errorf("got %d messages upstream, want none", n)
+			}
+		})
+	}
+
+	_, err := loadConfigLines(t, `mappings: [{"type": "static", "server": "127.0.0.1:25", "tls_pin": "abcd"}]`)
+	if err == nil || !strings.Contains(err.Error(), "tls_pin") {
+		t.Errorf("got %v for a short pin, want an error", err)
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	logs := captureLogs(t)
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "willi.test"))
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeFile(t, caFile, ca.pem)
+	a := startUpstream(t, &fakeUpstream{})
+	b := startUpstream(t, &fakeUpstream{})
+	table := filepath.Join(t.TempDir(), "mapping.csv")
+	writeFile(t, table, []byte("key;server;tls_verify\n"+
+		"tenant-a.test;"+a.addr()+";false\n"+
+		"tenant-b.test;"+b.addr()+";false\n"))
+	p := startProxy(t, `mappings: [{"type": "csv", "file": "`+table+`"}]`, "mapping_key: client_cert_cn",
+		"tls_cert: "+certFile, "tls_key: "+keyFile, "require_client_cert: true", "client_ca_file: "+caFile)
+
+	// Without STARTTLS
+	c := p.dial(t)
+	expectSMTPCode(t, c.Mail("sender@example.com", nil), ErrClientCertRequired.Code)
+	if len(logs.lines(`msg="Client did not authenticate with a certificate, rejecting"`, "client_tls=false")) != 1 {
+		t.Error("client without certificate not logged")
+	}
+
+	// Without a certificate, or with one of another CA, the handshake fails.
+	// With TLS 1.3, the client only notices with its next command.
+	for _, certs := range [][]tls.Certificate{nil, {newTestCA(t).issue(t, "tenant-a.test")}} {
+		c := p.dial(t)
+		err := c.StartTLS(&tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err == nil {
+			err = c.Mail("sender@example.com", nil)
+		}
+		if err == nil {
+			t.Errorf("got a session with certificates %v, want it rejected", certs)
+		}
+	}
+
+	// The certificate's CN selects the upstream
+	for _, tc := range []struct {
+		cn string
+		up *fakeUpstream
+	}{
+		{"tenant-a.test", a},
+		{"tenant-b.test", b},
+	} {
+		c := p.dial(t)
+		if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{ca.issue(t, tc.cn)}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+			t.Fatalf("%s: %v", tc.cn, err)
+		}
+		if n := len(tc.up.delivered()); n != 1 {
+			t.Errorf("%s: got %d messages at its upstream, want 1", tc.cn, n)
+		}
+		if len(logs.lines(`msg="Message accepted"`, "client_cert="+tc.cn)) != 1 {
+			t.Errorf("%s: certificate not part of the session's logs", tc.cn)
+		}
+	}
+}
+
+func TestRequireStarttls(t *testing.T) {
+	logs := captureLogs(t)
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "willi.test"))
+	up := startUpstream(t, &fakeUpstream{})
+	p := startProxy(t, up.static(), "tls_cert: "+certFile, "tls_key: "+keyFile, "require_starttls: true")
+
+	c := p.dial(t)
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("STARTTLS not advertised")
+	}
+	err := c.Mail("sender@example.com", nil)
+	expectSMTPCode(t, err, ErrStarttlsRequired.Code)
+	if code := err.(*smtp.SMTPError).EnhancedCode; code != ErrStarttlsRequired.EnhancedCode {
+		t.Errorf("got enhanced code %v, want %v", code, ErrStarttlsRequired.EnhancedCode)
+	}
+	c.Quit()
+
+	c = p.dial(t)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+	if err := c.StartTLS(&tls.Config{ServerName: "localhost", RootCAs: pool}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS advertised again after STARTTLS")
+	}
+	// willi doesn't authenticate clients with AUTH, see require_client_cert
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH advertised")
+	}
+	if err := sendMail(c, "sender@example.com", []string{"rcpt@example.org"}, testMessage); err != nil {
+		t.Fatalf("MAIL after STARTTLS: %v", err)
+	}
+	c.Quit()
+
+	eventually(t, "sessions finished", func() bool {
+		return len(logs.lines(`msg="Session finished"`)) == 2
+	})
+	if len(logs.lines(`msg="Session finished"`, "tls=false", "messages=0")) != 1 ||
+		len(logs.lines(`msg="Session finished"`, "tls=true", "messages=1")) != 1 {
+		t.Errorf("got %q, want the TLS use of each session logged", logs.lines(`msg="Session finished"`))
+	}
+	if n := len(up.delivered()); n != 1 {
+		t.Errorf("got %d messages upstream, want 1", n)
+	}
+}
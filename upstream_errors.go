@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// UpstreamError is an error that occurred while talking to an upstream server.
+type UpstreamError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// UpstreamErrors keeps the most recent errors of each upstream server.
+type UpstreamErrors struct {
+	mu     sync.Mutex
+	size   int
+	errors map[string][]UpstreamError
+}
+
+func NewUpstreamErrors(size int) *UpstreamErrors {
+	return &UpstreamErrors{
+		size:   size,
+		errors: make(map[string][]UpstreamError),
+	}
+}
+
+// Add records err for server, dropping the oldest error if the history of
+// server is full.
+func (e *UpstreamErrors) Add(server string, err error) {
+	if e == nil || e.size <= 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	list := e.errors[server]
+	if len(list) >= e.size {
+		n := copy(list, list[len(list)-e.size+1:])
+		list = list[:n]
+	}
+	e.errors[server] = append(list, UpstreamError{Time: time.Now(), Error: err.Error()})
+}
+
+// Get returns the recorded errors of server, oldest first.
+func (e *UpstreamErrors) Get(server string) []UpstreamError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]UpstreamError(nil), e.errors[server]...)
+}
+
+// All returns the recorded errors of all upstream servers, oldest first.
+func (e *UpstreamErrors) All() map[string][]UpstreamError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	all := make(map[string][]UpstreamError, len(e.errors))
+	for server, list := range e.errors {
+		all[server] = append([]UpstreamError(nil), list...)
+	}
+
+	return all
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// checkUpstreams connects to the upstream server of each static mapping,
+// greets it and quits, see check_upstream_on_start. Other mappings are not
+// checked, they may return any number of upstream servers. It returns false if
+// a check failed.
+func checkUpstreams(config *Config, resolver *Resolver) bool {
+	ok := true
+	for _, mapping := range config.Mappings {
+		static, isStatic := mapping.(*staticMapping)
+		if !isStatic {
+			continue
+		}
+
+		upstream := static.server
+		if upstream.TlsMode == TlsModeDefault {
+			upstream.TlsMode = TlsMode(config.UpstreamTlsMode)
+		}
+		ctx := []interface{}{"upstream", upstreamAddress(upstream), "tls_mode", upstream.TlsMode,
+			"tls_verify", upstream.TlsVerify, "tls_pin", upstream.TlsPin != ""}
+
+		start := time.Now()
+		usedTls, err := checkUpstream(resolver, config.Domain, upstream,
+			time.Duration(config.UpstreamGreetingTimeout))
+		if err != nil {
+			if reason, isVerify := tlsVerifyFailure(err); isVerify {
+				ctx = append(ctx, "reason", reason)
+			}
+			log.Error("Upstream server check failed", append(ctx, "error", err)...)
+			ok = false
+			continue
+		}
+
+		log.Info("Upstream server check succeeded", append(ctx, "tls", usedTls,
+			"duration", time.Since(start).Round(time.Millisecond))...)
+	}
+
+	return ok
+}
+
+// checkUpstream connects to upstream like a session would, up to and
+// including STARTTLS and AUTH, and quits. In auto TLS mode, STARTTLS is used if the
+// upstream server supports it. It returns whether the connection was
+// encrypted.
+func checkUpstream(resolver *Resolver, helo string, upstream Upstream, greetingTimeout time.Duration) (bool, error) {
+	address := upstreamAddress(upstream)
+	host, _, _ := net.SplitHostPort(address)
+	cfg := upstreamTlsConfig(host, upstream)
+
+	conn, err := resolver.Dial(address, "", nil, log.Root())
+	if err != nil {
+		return false, err
+	}
+
+	c, err := greetUpstream(conn, host, upstream.TlsMode, cfg, greetingTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	usedTls := upstream.TlsMode == TlsModeSmtps
+
+	if err := c.Hello(helo); err != nil {
+		return false, err
+	}
+
+	supported, _ := c.Extension("STARTTLS")
+	if upstream.TlsMode == TlsModeStarttls && !supported {
+		return false, fmt.Errorf("upstream server does not support STARTTLS (tls_mode %s)", upstream.TlsMode)
+	}
+	if supported && upstream.TlsMode != TlsModeNone && upstream.TlsMode != TlsModeSmtps {
+		if err := c.StartTLS(cfg); err != nil {
+			return false, err
+		}
+		usedTls = true
+	}
+
+	if err := authUpstream(c, upstream, usedTls); err != nil {
+		return false, err
+	}
+
+	return usedTls, c.Quit()
+}